@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/billziss-gh/golib/cmd"
+	"github.com/tryy3/gittyfs/control"
+	"github.com/tryy3/gittyfs/manager"
+)
+
+func newClient(c *cmd.Cmd, args []string) *control.Client {
+	c.Flag.Parse(args)
+	return control.NewClient(socketPath, mountName)
+}
+
+func statusMain(c *cmd.Cmd, args []string) {
+	client := newClient(c, args)
+
+	// Show every mount unless one was selected
+	names := []string{mountName}
+	if mountName == "" {
+		var err error
+		names, err = client.Mounts()
+		if err != nil {
+			log.Fatalf("status: %s", err)
+		}
+	}
+
+	statuses := map[string]manager.Status{}
+	for _, name := range names {
+		client.Mount = name
+		status, err := client.Status()
+		if err != nil {
+			log.Fatalf("status %s: %s", name, err)
+		}
+		statuses[name] = status
+	}
+
+	if statusJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if mountName != "" {
+			enc.Encode(statuses[mountName])
+		} else {
+			enc.Encode(statuses)
+		}
+		return
+	}
+
+	for i, name := range names {
+		if i > 0 {
+			fmt.Println()
+		}
+		if len(names) > 1 {
+			fmt.Printf("mount:   %s\n", name)
+		}
+		printStatus(statuses[name])
+	}
+}
+
+func printStatus(status manager.Status) {
+	fmt.Printf("branch:  %s\n", status.Branch)
+	fmt.Printf("head:    %s\n", status.Head)
+	fmt.Printf("paused:  %t\n", status.Paused)
+	if status.ReadOnly {
+		fmt.Printf("mode:    read-only\n")
+	}
+	if status.LastSync != nil {
+		fmt.Printf("synced:  %s\n", status.LastSync.Format("2006-01-02 15:04:05"))
+	}
+	if status.LastSyncError != "" {
+		fmt.Printf("error:   %s\n", status.LastSyncError)
+	}
+	if status.Ahead > 0 {
+		fmt.Printf("ahead:   %d commits ahead of remote\n", status.Ahead)
+	}
+	if status.LastPushError != "" {
+		fmt.Printf("push:    %s\n", status.LastPushError)
+	}
+	if len(status.Quarantined) > 0 {
+		fmt.Printf("\nquarantined commits (possible secrets, not pushed):\n")
+		for _, hash := range status.Quarantined {
+			fmt.Printf("  %s\n", hash)
+		}
+	}
+	if len(status.PendingChanges) > 0 {
+		fmt.Printf("\npending changes:\n")
+		for _, change := range status.PendingChanges {
+			if change.From != "" {
+				fmt.Printf("  %-8s %s (from %s)\n", change.Operation, change.Path, change.From)
+				continue
+			}
+			fmt.Printf("  %-8s %s\n", change.Operation, change.Path)
+		}
+	}
+}
+
+func syncMain(c *cmd.Cmd, args []string) {
+	client := newClient(c, args)
+	if err := client.Sync(); err != nil {
+		log.Fatalf("sync: %s", err)
+	}
+}
+
+func commitMain(c *cmd.Cmd, args []string) {
+	client := newClient(c, args)
+	if err := client.Commit(message); err != nil {
+		log.Fatalf("commit: %s", err)
+	}
+}
+
+func logMain(c *cmd.Cmd, args []string) {
+	client := newClient(c, args)
+
+	entries, err := client.Log(logCount)
+	if err != nil {
+		log.Fatalf("log: %s", err)
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("commit %s\n", entry.Hash)
+		fmt.Printf("Author: %s\n", entry.Author)
+		fmt.Printf("Date:   %s\n\n", entry.Date.Format("Mon Jan 2 15:04:05 2006 -0700"))
+		fmt.Printf("    %s\n\n", entry.Message)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/tryy3/gittyfs/config"
+	"github.com/tryy3/gittyfs/control"
+)
+
+// daemon keeps track of all mounts served by the process
+type daemon struct {
+	mu      sync.Mutex
+	mounts  map[string]*mountPoint
+	server  *control.Server
+	changed chan struct{}
+}
+
+func newDaemon(server *control.Server) *daemon {
+	return &daemon{
+		mounts:  map[string]*mountPoint{},
+		server:  server,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+func (d *daemon) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.mounts)
+}
+
+// apply brings the running mounts in line with the given configuration,
+// mounts that changed are unmounted and mounted again
+func (d *daemon) apply(mounts []config.Mount) {
+	wanted := map[string]config.Mount{}
+	for _, conf := range mounts {
+		wanted[conf.Name] = conf
+	}
+
+	d.mu.Lock()
+	var remove []*mountPoint
+	for name, mp := range d.mounts {
+		if conf, ok := wanted[name]; !ok || !reflect.DeepEqual(conf, mp.conf) {
+			remove = append(remove, mp)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, mp := range remove {
+		log.Printf("Removing mount %s", mp.conf.Name)
+		d.remove(mp)
+	}
+
+	for _, conf := range mounts {
+		d.mu.Lock()
+		_, exists := d.mounts[conf.Name]
+		d.mu.Unlock()
+		if exists {
+			continue
+		}
+
+		log.Printf("Adding mount %s on %s", conf.Name, conf.Path)
+		mp, err := startMount(conf)
+		if err != nil {
+			log.Printf("Error mounting %s: %s", conf.Name, err)
+			continue
+		}
+		d.add(mp)
+	}
+}
+
+func (d *daemon) add(mp *mountPoint) {
+	d.mu.Lock()
+	d.mounts[mp.conf.Name] = mp
+	d.mu.Unlock()
+	d.server.Add(mp.conf.Name, mp.manager)
+
+	// The filesystem can also go away because someone ran 'gittyfs unmount'
+	go func() {
+		mp.fs.Wait()
+		log.Printf("Unmounted %s", mp.conf.Path)
+
+		d.mu.Lock()
+		if d.mounts[mp.conf.Name] == mp {
+			delete(d.mounts, mp.conf.Name)
+			d.server.Remove(mp.conf.Name)
+		}
+		d.mu.Unlock()
+
+		mp.manager.Stop()
+		if err := os.RemoveAll(mp.dir); err != nil {
+			log.Printf("Error removing %s: %s", mp.dir, err)
+		}
+		close(mp.stopped)
+
+		select {
+		case d.changed <- struct{}{}:
+		default:
+		}
+	}()
+}
+
+// remove unmounts a mount and waits for its manager to flush
+func (d *daemon) remove(mp *mountPoint) {
+	d.mu.Lock()
+	delete(d.mounts, mp.conf.Name)
+	d.server.Remove(mp.conf.Name)
+	d.mu.Unlock()
+
+	if err := mp.fs.Unmount(); err != nil {
+		// Still mounted, so keep serving it
+		log.Printf("Error unmounting %s: %s", mp.conf.Path, err)
+		d.mu.Lock()
+		d.mounts[mp.conf.Name] = mp
+		d.server.Add(mp.conf.Name, mp.manager)
+		d.mu.Unlock()
+		return
+	}
+	<-mp.stopped
+}
+
+func (d *daemon) shutdown() {
+	d.mu.Lock()
+	mounts := make([]*mountPoint, 0, len(d.mounts))
+	for _, mp := range d.mounts {
+		mounts = append(mounts, mp)
+	}
+	d.mu.Unlock()
+
+	for _, mp := range mounts {
+		d.remove(mp)
+	}
+}
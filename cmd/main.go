@@ -1,121 +1,123 @@
 package main
 
 import (
-	"crypto"
-	"crypto/sha1"
 	"flag"
-	"fmt"
-	"log"
 	"os"
+	"strings"
 
-	"github.com/go-git/go-billy/v5/memfs"
-	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing/hash"
-	"github.com/go-git/go-git/v5/plumbing/transport"
-	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
-	"github.com/go-git/go-git/v5/storage/memory"
-	"github.com/tryy3/gittyfs/gittyfuse"
+	"github.com/billziss-gh/golib/cmd"
+	"github.com/tryy3/gittyfs/control"
 	"github.com/tryy3/gittyfs/manager"
 )
 
-func createRepository(url string, authFile string) (*git.Repository, error) {
-	hash.RegisterHash(crypto.SHA1, sha1.New)
-	// trace.SetTarget(trace.Packet)
-	ep, err := transport.NewEndpoint(url)
-	if err != nil {
-		log.Fatalf("new endpoint %s: %s", url, err)
-	}
+var cmdmap = cmd.NewCmdMap()
 
-	var authMethod transport.AuthMethod
-	if authFile != "" {
-		authMethod, err = ssh.NewPublicKeysFromFile(ep.User, authFile, "")
-		if err != nil {
-			log.Fatalf("new public keys from file %s: %s", authFile, err)
-		}
-	} else {
-		authMethod, err = ssh.NewSSHAgentAuth(ep.User)
-		if err != nil {
-			log.Fatalf("new ssh agent auth %s: %s", ep.User, err)
-		}
-	}
+// stringList is a flag that can be given several times
+type stringList []string
 
-	wt := memfs.New()
-	storer := memory.NewStorage()
-	r, err := git.Clone(storer, wt, &git.CloneOptions{
-		Auth:         authMethod,
-		URL:          url,
-		Tags:         git.NoTags,
-		Depth:        1,
-		SingleBranch: true,
-		// Progress:     os.Stdout,
-	})
-
-	if err != nil {
-		log.Fatalf("git clone %s: %s", url, err)
-	}
-
-	return r, nil
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
 }
 
-// Mount path
-// UID
-// GID
-// GIT
-
-func main() {
-	var gitURL string
-	var UID string
-	var GID string
-	var authFile string
-
-	flag.StringVar(&gitURL, "git", "", "git url")
-	flag.StringVar(&UID, "uid", "", "uid")
-	flag.StringVar(&GID, "gid", "", "gid")
-	flag.StringVar(&authFile, "auth", "", "auth file")
-	flag.Parse()
-
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] <mount_path>\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		flag.PrintDefaults()
-	}
-
-	// Parse flags
-	flag.Parse()
-
-	// Get positional arguments (after the flags)
-	args := flag.Args()
-	if len(args) < 1 {
-		flag.Usage()
-		log.Fatal("Error: Mount path is required")
-	}
-
-	if gitURL == "" {
-		flag.Usage()
-		log.Fatal("Error: Git URL is required")
-	}
-
-	mountPath := args[0]
-
-	// Clone the given repository to the given directory
-	log.Printf("git clone %s", gitURL)
-
-	repo, err := createRepository(gitURL, authFile)
-	if err != nil {
-		log.Fatalf("git clone %s: %s", gitURL, err)
-	}
-
-	manager := manager.NewManager(repo, authFile)
-	go manager.Run()
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
 
-	wt, err := repo.Worktree()
-	if err != nil {
-		log.Fatalf("git worktree %s: %s", gitURL, err)
-	}
+var (
+	configPath string
+	gitURL     string
+	branch     string
+	UID        string
+	GID        string
+	authFile   string
+	socketPath string
+	mountName  string
+	commitMode string
+	message    string
+	ignore     string
+
+	signingKey    string
+	signingFormat string
+	authorName    string
+	authorEmail   string
+	pushBranch    string
+	preCommit     stringList
+	repoHooks     bool
+	secretPattern stringList
+	noSecretScan  bool
+	maxFileSize   string
+	maxCommitSize string
+	maxRepoSize   string
+	refuseBinary  bool
+	allowBinary   string
+	lfsURL        string
+	partial       bool
+	subdir        string
+	sparse        string
+	blobCacheSize string
+	readOnly      bool
+	cacheDir      string
+	logCount      int
+	statusJSON    bool
+)
 
-	fs := gittyfuse.NewFilesystem(wt.Filesystem, manager, UID, GID)
-	go fs.Mount(mountPath)
-	defer fs.Unmount()
+func init() {
+	c := cmdmap.Add("mount [-options] [mount_path]\nmount a git repository, or all repositories of a config file", mountMain)
+	c.Flag.StringVar(&configPath, "config", "", "config file describing the mounts (reloaded on SIGHUP)")
+	c.Flag.StringVar(&gitURL, "git", "", "git url")
+	c.Flag.StringVar(&branch, "branch", "", "branch to mount (default is the remote HEAD)")
+	c.Flag.StringVar(&UID, "uid", "", "uid")
+	c.Flag.StringVar(&GID, "gid", "", "gid")
+	c.Flag.StringVar(&authFile, "auth", "", "auth file")
+	c.Flag.StringVar(&commitMode, "commit-mode", "auto", "when to commit: auto, manual or squash")
+	c.Flag.StringVar(&ignore, "ignore", strings.Join(manager.DefaultIgnorePatterns, ","), "comma separated gitignore patterns that are never committed")
+	c.Flag.StringVar(&signingKey, "signing-key", "", "key to sign commits with (default is the git config user.signingkey)")
+	c.Flag.StringVar(&signingFormat, "signing-format", "", "signing key format: openpgp or ssh (default is the git config gpg.format)")
+	c.Flag.StringVar(&authorName, "author-name", "", "name commits are made as, must match the signing key (default is the git config user.name)")
+	c.Flag.StringVar(&authorEmail, "author-email", "", "email commits are made as, must match the signing key (default is the git config user.email)")
+	c.Flag.Var(&preCommit, "pre-commit", "shell command run against the staged tree before each commit (repeatable)")
+	c.Flag.BoolVar(&repoHooks, "repo-hooks", false, "run the repository's .githooks/pre-commit when no -pre-commit is given, it runs code from the remote")
+	c.Flag.Var(&secretPattern, "secret-pattern", "regular expression for secrets that must not be pushed (repeatable)")
+	c.Flag.BoolVar(&noSecretScan, "no-secret-scan", false, "do not scan commits for secrets")
+	c.Flag.StringVar(&maxFileSize, "max-file-size", "", "largest size a file may grow to, e.g. 50MB (default no limit)")
+	c.Flag.StringVar(&maxCommitSize, "max-commit-size", "", "largest total size of the files changed by a commit (default no limit)")
+	c.Flag.StringVar(&maxRepoSize, "max-repo-size", "", "largest total size of the worktree, reported as the size of the mount (default no limit)")
+	c.Flag.BoolVar(&refuseBinary, "refuse-binary", false, "refuse to commit binary files not matching -allow-binary")
+	c.Flag.StringVar(&allowBinary, "allow-binary", "", "comma separated gitignore patterns of binary files that may be committed")
+	c.Flag.StringVar(&lfsURL, "lfs-url", "", "Git LFS server (default is lfs.url or derived from the git url)")
+	c.Flag.BoolVar(&partial, "partial", false, "clone without blobs and fetch files when they are first opened")
+	c.Flag.StringVar(&blobCacheSize, "blob-cache-size", "", "memory for the blobs fetched by -partial, e.g. 256MB (default 64MB)")
+	c.Flag.StringVar(&subdir, "subdir", "", "directory of the repository to mount instead of its root")
+	c.Flag.StringVar(&sparse, "sparse", "", "comma separated gitignore patterns of the paths to put in the mount (default all)")
+	c.Flag.BoolVar(&readOnly, "read-only", false, "mount the cloned commit read-only, nothing is committed or pushed")
+	c.Flag.StringVar(&pushBranch, "push-branch", "", "commit and push to this new branch instead of the mounted one, e.g. "+manager.SessionBranch)
+	c.Flag.StringVar(&cacheDir, "cache-dir", "", "directory for the clones and the temporary files of large writes (default is the temporary directory)")
+	c.Flag.StringVar(&socketPath, "socket", control.DefaultSocketPath(), "control socket path (empty to disable)")
+
+	cmdmap.Add("unmount mount_path\nunmount a mounted repository", unmountMain)
+
+	c = cmdmap.Add("status [-options]\nshow the status of a running mount", statusMain)
+	c.Flag.StringVar(&socketPath, "socket", control.DefaultSocketPath(), "control socket path")
+	c.Flag.StringVar(&mountName, "mount", "", "mount name when the process serves several mounts")
+	c.Flag.BoolVar(&statusJSON, "json", false, "print the status as JSON")
+
+	c = cmdmap.Add("sync [-options]\nforce a sync of pending changes", syncMain)
+	c.Flag.StringVar(&socketPath, "socket", control.DefaultSocketPath(), "control socket path")
+	c.Flag.StringVar(&mountName, "mount", "", "mount name when the process serves several mounts")
+
+	c = cmdmap.Add("commit [-options]\ncommit and push all changes as a checkpoint", commitMain)
+	c.Flag.StringVar(&socketPath, "socket", control.DefaultSocketPath(), "control socket path")
+	c.Flag.StringVar(&mountName, "mount", "", "mount name when the process serves several mounts")
+	c.Flag.StringVar(&message, "m", "", "commit message")
+
+	c = cmdmap.Add("log [-options]\nshow the commit log of a running mount", logMain)
+	c.Flag.StringVar(&socketPath, "socket", control.DefaultSocketPath(), "control socket path")
+	c.Flag.StringVar(&mountName, "mount", "", "mount name when the process serves several mounts")
+	c.Flag.IntVar(&logCount, "n", 20, "number of commits to show")
+}
 
-	select {}
+func main() {
+	flag.Usage = cmd.UsageFunc(cmdmap)
+	cmdmap.Run(flag.CommandLine, os.Args[1:])
 }
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/billziss-gh/golib/cmd"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/hash"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/tryy3/gittyfs/config"
+	"github.com/tryy3/gittyfs/control"
+	"github.com/tryy3/gittyfs/gittyfuse"
+	"github.com/tryy3/gittyfs/manager"
+)
+
+// createRepository clones url into a new directory of the cache dir that is
+// returned for the caller to remove
+func createRepository(url string, branch string, authFile string, partial bool, blobCacheSize int64) (*git.Repository, string, error) {
+	hash.RegisterHash(crypto.SHA1, sha1.New)
+	// trace.SetTarget(trace.Packet)
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, "", fmt.Errorf("new endpoint %s: %w", url, err)
+	}
+
+	var authMethod transport.AuthMethod
+	if authFile != "" {
+		authMethod, err = ssh.NewPublicKeysFromFile(ep.User, authFile, "")
+		if err != nil {
+			return nil, "", fmt.Errorf("new public keys from file %s: %w", authFile, err)
+		}
+	} else {
+		authMethod, err = ssh.NewSSHAgentAuth(ep.User)
+		if err != nil {
+			return nil, "", fmt.Errorf("new ssh agent auth %s: %w", ep.User, err)
+		}
+	}
+
+	// Clones are kept on disk, files are only read from the objects once
+	// they are opened
+	dir, err := os.MkdirTemp(cacheDir, "gittyfs-repo-")
+	if err != nil {
+		return nil, "", fmt.Errorf("git clone %s: %w", url, err)
+	}
+	var r *git.Repository
+	if partial {
+		r, err = manager.ClonePartial(url, branch, authMethod, blobCacheSize, dir, gittyfuse.StreamThreshold)
+	} else {
+		r, err = manager.Clone(url, branch, authMethod, dir, gittyfuse.StreamThreshold)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, "", fmt.Errorf("git clone %s: %w", url, err)
+	}
+
+	return r, dir, nil
+}
+
+// mountPoint is a single mounted repository with its manager
+type mountPoint struct {
+	conf    config.Mount
+	manager *manager.Manager
+	fs      *gittyfuse.Filesystem
+	stopped chan struct{}
+
+	// dir holds the clone
+	dir string
+}
+
+func startMount(conf config.Mount) (*mountPoint, error) {
+	// Clone the given repository to the given directory
+	log.Printf("git clone %s", conf.URL)
+
+	repo, dir, err := createRepository(conf.URL, conf.Branch, conf.Auth, conf.Partial, int64(conf.BlobCacheSize))
+	if err != nil {
+		return nil, err
+	}
+	mp, err := mountRepository(conf, repo, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return mp, nil
+}
+
+// mountRepository starts a manager for repo, cloned into dir, and mounts its
+// worktree
+func mountRepository(conf config.Mount, repo *git.Repository, dir string) (*mountPoint, error) {
+	commitMode, err := manager.ParseCommitMode(conf.Sync.CommitMode)
+	if err != nil {
+		return nil, err
+	}
+
+	var signingFormat manager.SigningFormat
+	if conf.SigningFormat != "" {
+		signingFormat, err = manager.ParseSigningFormat(conf.SigningFormat)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manager, err := manager.NewManager(repo, conf.Auth, manager.Options{
+		SyncInterval:  conf.Sync.Interval.Duration,
+		Paused:        conf.Sync.Paused,
+		CommitMode:    commitMode,
+		Ignore:        conf.Ignore,
+		SigningKey:    conf.SigningKey,
+		SigningFormat: signingFormat,
+		AuthorName:    conf.AuthorName,
+		AuthorEmail:   conf.AuthorEmail,
+		PreCommit:     conf.PreCommit,
+		RepoHooks:     conf.RepoHooks,
+		Limits: manager.Limits{
+			MaxFileSize:   int64(conf.Limits.MaxFileSize),
+			MaxCommitSize: int64(conf.Limits.MaxCommitSize),
+			MaxRepoSize:   int64(conf.Limits.MaxRepoSize),
+			RefuseBinary:  conf.Limits.RefuseBinary,
+			AllowBinary:   conf.Limits.AllowBinary,
+		},
+		SecretPatterns: conf.SecretPatterns,
+		NoSecretScan:   conf.NoSecretScan,
+		LFSURL:         conf.LFSURL,
+		PushBranch:     conf.PushBranch,
+		ReadOnly:       conf.ReadOnly,
+		Dir:            dir,
+	})
+	if err != nil {
+		return nil, err
+	}
+	go manager.Run()
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		manager.Stop()
+		return nil, fmt.Errorf("git worktree %s: %w", conf.URL, err)
+	}
+
+	fs := gittyfuse.NewFilesystem(wt.Filesystem, manager, conf.UID, conf.GID)
+	fs.Subdir = conf.Subdir
+	fs.Sparse = conf.Sparse
+	if err := fs.Mount(conf.Path); err != nil {
+		manager.Stop()
+		return nil, err
+	}
+
+	return &mountPoint{
+		conf:    conf,
+		manager: manager,
+		fs:      fs,
+		stopped: make(chan struct{}),
+		dir:     dir,
+	}, nil
+}
+
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func mountMain(c *cmd.Cmd, args []string) {
+	c.Flag.Parse(args)
+
+	var conf *config.Config
+	if configPath != "" {
+		var err error
+		conf, err = config.Load(configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		// Get positional arguments (after the flags)
+		if c.Flag.NArg() < 1 {
+			c.Flag.Usage()
+			log.Fatal("Error: Mount path is required")
+		}
+
+		if gitURL == "" {
+			c.Flag.Usage()
+			log.Fatal("Error: Git URL is required")
+		}
+
+		limits := config.Limits{
+			RefuseBinary: refuseBinary,
+			AllowBinary:  splitList(allowBinary),
+		}
+		if maxFileSize != "" {
+			size, err := config.ParseSize(maxFileSize)
+			if err != nil {
+				log.Fatalf("Error: -max-file-size: %s", err)
+			}
+			limits.MaxFileSize = size
+		}
+		if maxCommitSize != "" {
+			size, err := config.ParseSize(maxCommitSize)
+			if err != nil {
+				log.Fatalf("Error: -max-commit-size: %s", err)
+			}
+			limits.MaxCommitSize = size
+		}
+		if maxRepoSize != "" {
+			size, err := config.ParseSize(maxRepoSize)
+			if err != nil {
+				log.Fatalf("Error: -max-repo-size: %s", err)
+			}
+			limits.MaxRepoSize = size
+		}
+
+		var cacheSize config.Size
+		if blobCacheSize != "" {
+			size, err := config.ParseSize(blobCacheSize)
+			if err != nil {
+				log.Fatalf("Error: -blob-cache-size: %s", err)
+			}
+			cacheSize = size
+		}
+
+		mountPath := filepath.Clean(c.Flag.Arg(0))
+		conf = &config.Config{
+			Mounts: []config.Mount{{
+				Name:   filepath.Base(mountPath),
+				URL:    gitURL,
+				Branch: branch,
+				Path:   mountPath,
+				UID:    UID,
+				GID:    GID,
+				Auth:   authFile,
+				Sync: config.Sync{
+					CommitMode: commitMode,
+				},
+				Limits:         limits,
+				Ignore:         splitList(ignore),
+				SigningKey:     signingKey,
+				SigningFormat:  signingFormat,
+				AuthorName:     authorName,
+				AuthorEmail:    authorEmail,
+				PreCommit:      preCommit,
+				RepoHooks:      repoHooks,
+				SecretPatterns: secretPattern,
+				NoSecretScan:   noSecretScan,
+				LFSURL:         lfsURL,
+				Partial:        partial,
+				Subdir:         subdir,
+				Sparse:         splitList(sparse),
+				BlobCacheSize:  cacheSize,
+				PushBranch:     pushBranch,
+				ReadOnly:       readOnly,
+			}},
+		}
+	}
+
+	if conf.Socket != "" {
+		socketPath = conf.Socket
+	}
+	if conf.CacheDir != "" {
+		cacheDir = conf.CacheDir
+	}
+	if cacheDir != "" {
+		if err := os.MkdirAll(cacheDir, 0700); err != nil {
+			log.Fatalf("cache dir: %s", err)
+		}
+		gittyfuse.CacheDir = cacheDir
+	}
+
+	server := control.NewServer()
+	if socketPath != "" {
+		if err := server.Listen(socketPath); err != nil {
+			log.Fatalf("control socket: %s", err)
+		}
+		defer server.Close()
+		go func() {
+			if err := server.Serve(); err != nil {
+				log.Printf("control socket: %s", err)
+			}
+		}()
+	}
+
+	d := newDaemon(server)
+	d.apply(conf.Mounts)
+	if configPath == "" && d.count() == 0 {
+		log.Fatal("Error: Mount failed")
+	}
+
+	// Reload the configuration on SIGHUP, unmount everything on interrupt
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for {
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				d.shutdown()
+				return
+			}
+			if configPath == "" {
+				log.Printf("No config file to reload")
+				continue
+			}
+			log.Printf("Reloading %s", configPath)
+			conf, err := config.Load(configPath)
+			if err != nil {
+				log.Printf("Reload failed, keeping current mounts: %s", err)
+				continue
+			}
+			d.apply(conf.Mounts)
+
+		case <-d.changed:
+			// Without a config file there is nothing to reload, so we are
+			// done once the last mount is gone
+			if configPath == "" && d.count() == 0 {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+	"syscall"
+
+	"github.com/billziss-gh/golib/cmd"
+)
+
+// unmount lazily detaches the mount, falling back to fusermount when we are
+// not privileged enough to call umount ourselves
+func unmount(path string) error {
+	err := syscall.Unmount(path, syscall.MNT_DETACH)
+	if err == nil {
+		return nil
+	}
+	log.Printf("umount %s: %s, trying fusermount", path, err)
+
+	fusermount, lookErr := exec.LookPath("fusermount3")
+	if lookErr != nil {
+		fusermount = "fusermount"
+	}
+	out, err := exec.Command(fusermount, "-u", "-z", path).CombinedOutput()
+	if err != nil {
+		log.Printf("%s", out)
+		return err
+	}
+	return nil
+}
+
+func unmountMain(c *cmd.Cmd, args []string) {
+	c.Flag.Parse(args)
+	if c.Flag.NArg() != 1 {
+		c.Flag.Usage()
+		log.Fatal("Error: Mount path is required")
+	}
+
+	mountPath := c.Flag.Arg(0)
+	if err := unmount(mountPath); err != nil {
+		log.Fatalf("unmount %s: %s", mountPath, err)
+	}
+}
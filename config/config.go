@@ -0,0 +1,294 @@
+// Package config loads the gittyfs configuration file describing the mounts
+// a single gittyfs process serves.
+//
+// Example:
+//
+//	socket = "/run/gittyfs.sock"
+//	cache_dir = "/var/cache/gittyfs"
+//
+//	[[mount]]
+//	name = "docs"
+//	url = "git@github.com:example/docs.git"
+//	branch = "main"
+//	path = "/mnt/docs"
+//	uid = "1000"
+//	gid = "1000"
+//	auth = "/etc/gittyfs/id_ed25519"
+//	ignore = ["*.swp", "*~", "build/"]
+//	signing_key = "/etc/gittyfs/id_ed25519"
+//	signing_format = "ssh"
+//	author_name = "Docs Bot"
+//	author_email = "docs-bot@example.com"
+//	push_branch = "gittyfs/{hostname}/{date}-{time}"
+//	pre_commit = ["jq empty *.json"]
+//	repo_hooks = false
+//	secret_patterns = ["INTERNAL-[0-9a-f]{32}"]
+//	lfs_url = "https://lfs.example.com/docs"
+//	partial = true
+//	subdir = "docs"
+//	sparse = ["*.md", "!drafts/"]
+//	blob_cache_size = "256MB"
+//	read_only = false
+//
+//	[mount.sync]
+//	interval = "10s"
+//	paused = false
+//	commit_mode = "auto"
+//
+//	[mount.limits]
+//	max_file_size = "50MB"
+//	max_commit_size = "200MB"
+//	max_repo_size = "1GB"
+//	refuse_binary = true
+//	allow_binary = ["*.png", "*.pdf"]
+package config
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/tryy3/gittyfs/manager"
+)
+
+// Config is the top level configuration file
+type Config struct {
+	// Socket is the control socket path, empty means the default path
+	Socket string `toml:"socket"`
+
+	// CacheDir holds the clones of the mounts and the temporary files of
+	// large writes, empty means the default temporary directory
+	CacheDir string `toml:"cache_dir"`
+
+	Mounts []Mount `toml:"mount"`
+}
+
+// Mount describes a single repository mount
+type Mount struct {
+	Name   string `toml:"name"`
+	URL    string `toml:"url"`
+	Branch string `toml:"branch"`
+	Path   string `toml:"path"`
+	UID    string `toml:"uid"`
+	GID    string `toml:"gid"`
+	Auth   string `toml:"auth"`
+	Sync   Sync   `toml:"sync"`
+	Limits Limits `toml:"limits"`
+
+	// Ignore holds gitignore style patterns for files that live in the
+	// mount but are never committed, left out it defaults to common editor
+	// swap and backup files
+	Ignore []string `toml:"ignore"`
+
+	// SigningKey and SigningFormat ("openpgp" or "ssh") sign commits, left
+	// out the git config user.signingkey and gpg.format are used
+	SigningKey    string `toml:"signing_key"`
+	SigningFormat string `toml:"signing_format"`
+
+	// AuthorName and AuthorEmail are who commits are made as, left out the
+	// git config user.name and user.email are used. With a signing key they
+	// have to match the identity of the key for commits to show as verified.
+	AuthorName  string `toml:"author_name"`
+	AuthorEmail string `toml:"author_email"`
+
+	// PreCommit holds shell commands run against a checkout of the staged
+	// tree before each commit. Left out the repository's own
+	// .githooks/pre-commit is run if it has one and RepoHooks is set, anyone
+	// who can push to the remote can change it.
+	PreCommit []string `toml:"pre_commit"`
+	RepoHooks bool     `toml:"repo_hooks"`
+
+	// SecretPatterns holds regular expressions for secrets on top of the
+	// built in ones, commits adding a match are quarantined instead of
+	// pushed. NoSecretScan turns the scan off.
+	SecretPatterns []string `toml:"secret_patterns"`
+	NoSecretScan   bool     `toml:"no_secret_scan"`
+
+	// LFSURL is the Git LFS server for files .gitattributes puts in LFS,
+	// left out it is found from lfs.url or the remote url like git-lfs does
+	LFSURL string `toml:"lfs_url"`
+
+	// Partial clones only commits and trees, blobs are fetched from the
+	// remote when files are first opened and kept in a cache of at most
+	// BlobCacheSize bytes. Pre-commit hooks only see the files whose blobs
+	// are at hand.
+	Partial       bool `toml:"partial"`
+	BlobCacheSize Size `toml:"blob_cache_size"`
+
+	// Subdir mounts a directory of the repository instead of its root and
+	// Sparse holds gitignore style patterns of the paths that are in the
+	// mount, either way commits still hold the whole tree. Files outside
+	// the mount are never read, with Partial their blobs are never fetched.
+	Subdir string   `toml:"subdir"`
+	Sparse []string `toml:"sparse"`
+
+	// ReadOnly mounts the commit the repository was cloned at read-only,
+	// nothing is ever committed or pushed and the mount does not follow
+	// the remote
+	ReadOnly bool `toml:"read_only"`
+
+	// PushBranch makes the mount commit and push to a new branch instead
+	// of the mounted one, it may use the placeholders {hostname}, {date},
+	// {time} and {branch}
+	PushBranch string `toml:"push_branch"`
+}
+
+// Sync describes the sync policy of a mount
+type Sync struct {
+	// Interval is how long the mount has to be quiet before changes are
+	// committed and pushed, zero means the manager default
+	Interval Duration `toml:"interval"`
+
+	// Paused starts the mount with automatic sync paused
+	Paused bool `toml:"paused"`
+
+	// CommitMode is one of "auto", "manual" or "squash", empty means auto
+	CommitMode string `toml:"commit_mode"`
+}
+
+// Limits bounds what may be written to a mount
+type Limits struct {
+	// MaxFileSize makes writes beyond it fail with EFBIG, zero is no limit
+	MaxFileSize Size `toml:"max_file_size"`
+
+	// MaxCommitSize bounds the total size of the files a commit changes,
+	// zero is no limit
+	MaxCommitSize Size `toml:"max_commit_size"`
+
+	// MaxRepoSize bounds the total size of the worktree and is reported as
+	// the size of the mount, zero is no limit
+	MaxRepoSize Size `toml:"max_repo_size"`
+
+	// RefuseBinary refuses to commit binary files unless they match one of
+	// the gitignore style patterns in AllowBinary
+	RefuseBinary bool     `toml:"refuse_binary"`
+	AllowBinary  []string `toml:"allow_binary"`
+}
+
+// Size is a byte count that is written as a string such as "10MB", units
+// are multiples of 1024
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
+
+// ParseSize parses a byte count with an optional unit such as "512K"
+func ParseSize(s string) (Size, error) {
+	number := strings.TrimSpace(s)
+	factor := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(strings.ToUpper(number), strings.ToUpper(unit.suffix)) {
+			number = strings.TrimSpace(number[:len(number)-len(unit.suffix)])
+			factor = unit.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/factor {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return Size(n * factor), nil
+}
+
+func (s *Size) UnmarshalText(text []byte) error {
+	var err error
+	*s, err = ParseSize(string(text))
+	return err
+}
+
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(strconv.FormatInt(int64(s), 10)), nil
+}
+
+// Duration is a time.Duration that is written as a string such as "10s"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Load reads and validates the configuration file at path
+func Load(path string) (*Config, error) {
+	var conf Config
+	md, err := toml.DecodeFile(path, &conf)
+	if err != nil {
+		return nil, fmt.Errorf("read config %s: %w", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("read config %s: unknown key %s", path, undecoded[0])
+	}
+
+	if err := conf.validate(); err != nil {
+		return nil, fmt.Errorf("read config %s: %w", path, err)
+	}
+
+	return &conf, nil
+}
+
+func (c *Config) validate() error {
+	names := map[string]bool{}
+	paths := map[string]bool{}
+
+	for i := range c.Mounts {
+		m := &c.Mounts[i]
+		if m.URL == "" {
+			return fmt.Errorf("mount %d: url is required", i)
+		}
+		if m.Path == "" {
+			return fmt.Errorf("mount %d: path is required", i)
+		}
+		m.Path = filepath.Clean(m.Path)
+		if m.Name == "" {
+			m.Name = filepath.Base(m.Path)
+		}
+		if m.Sync.Interval.Duration < 0 {
+			return fmt.Errorf("mount %s: negative sync interval", m.Name)
+		}
+		if _, err := manager.ParseCommitMode(m.Sync.CommitMode); err != nil {
+			return fmt.Errorf("mount %s: %w", m.Name, err)
+		}
+		if _, err := manager.ParseSigningFormat(m.SigningFormat); err != nil {
+			return fmt.Errorf("mount %s: %w", m.Name, err)
+		}
+		for _, p := range m.SecretPatterns {
+			if _, err := regexp.Compile(p); err != nil {
+				return fmt.Errorf("mount %s: secret pattern %q: %w", m.Name, p, err)
+			}
+		}
+		if m.Ignore == nil {
+			m.Ignore = append([]string{}, manager.DefaultIgnorePatterns...)
+		}
+
+		if names[m.Name] {
+			return fmt.Errorf("mount %s: duplicate name", m.Name)
+		}
+		if paths[m.Path] {
+			return fmt.Errorf("mount %s: duplicate path %s", m.Name, m.Path)
+		}
+		names[m.Name] = true
+		paths[m.Path] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/tryy3/gittyfs/manager"
+)
+
+// Client talks to a running gittyfs over its control socket
+type Client struct {
+	client *http.Client
+
+	// Mount selects the mount requests are sent for, it may be empty when
+	// the process serves a single mount
+	Mount string
+}
+
+func NewClient(socketPath string, mount string) *Client {
+	return &Client{
+		Mount: mount,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// Mounts returns the names of all mounts of the process
+func (c *Client) Mounts() ([]string, error) {
+	var names []string
+	err := c.do(http.MethodGet, "/mounts", nil, nil, &names)
+	return names, err
+}
+
+// Status returns the manager status
+func (c *Client) Status() (manager.Status, error) {
+	var status manager.Status
+	err := c.do(http.MethodGet, "/status", nil, nil, &status)
+	return status, err
+}
+
+// Log returns up to n commits of the mounted branch
+func (c *Client) Log(n int) ([]manager.LogEntry, error) {
+	var entries []manager.LogEntry
+	query := url.Values{"n": {strconv.Itoa(n)}}
+	err := c.do(http.MethodGet, "/log", query, nil, &entries)
+	return entries, err
+}
+
+// Sync forces a sync of pending changes
+func (c *Client) Sync() error {
+	return c.post("/sync")
+}
+
+// Commit commits and pushes all changes with the given message
+func (c *Client) Commit(message string) error {
+	var result Result
+	return c.do(http.MethodPost, "/commit", nil, CommitRequest{Message: message}, &result)
+}
+
+// Pause pauses the automatic sync
+func (c *Client) Pause() error {
+	return c.post("/pause")
+}
+
+// Resume resumes the automatic sync
+func (c *Client) Resume() error {
+	return c.post("/resume")
+}
+
+// Fetch fetches from the remote
+func (c *Client) Fetch() error {
+	return c.post("/fetch")
+}
+
+func (c *Client) post(path string) error {
+	var result Result
+	return c.do(http.MethodPost, path, nil, nil, &result)
+}
+
+func (c *Client) do(method, path string, query url.Values, body any, v any) error {
+	if c.Mount != "" {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("mount", c.Mount)
+	}
+
+	u := url.URL{Scheme: "http", Host: "gittyfs", Path: path, RawQuery: query.Encode()}
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, u.String(), reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("control request %s %s: %w", method, path, err)
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		var result Result
+		if err := json.NewDecoder(rsp.Body).Decode(&result); err != nil || result.Error == "" {
+			return fmt.Errorf("control request %s %s: %s", method, path, rsp.Status)
+		}
+		return errors.New(result.Error)
+	}
+
+	return json.NewDecoder(rsp.Body).Decode(v)
+}
@@ -0,0 +1,247 @@
+// Package control exposes a running gittyfs over a small JSON HTTP API
+// served on a Unix domain socket.
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/tryy3/gittyfs/manager"
+)
+
+// DefaultSocketPath returns the socket path used when none is configured
+func DefaultSocketPath() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "gittyfs.sock")
+}
+
+// Result is the response body of the POST endpoints
+type Result struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// CommitRequest is the request body of POST /commit
+type CommitRequest struct {
+	Message string `json:"message"`
+}
+
+// Server serves the control API for the managers of all mounts of a process
+//
+// Requests select a mount with the "mount" query parameter, it may be left
+// out when only a single mount is served.
+type Server struct {
+	mu       sync.Mutex
+	managers map[string]*manager.Manager
+	listener net.Listener
+	server   *http.Server
+}
+
+func NewServer() *Server {
+	s := &Server{
+		managers: map[string]*manager.Manager{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /mounts", s.handleMounts)
+	mux.HandleFunc("GET /status", s.withManager(s.handleStatus))
+	mux.HandleFunc("POST /sync", s.withManager(s.handleSync))
+	mux.HandleFunc("POST /commit", s.withManager(s.handleCommit))
+	mux.HandleFunc("POST /pause", s.withManager(s.handlePause))
+	mux.HandleFunc("POST /resume", s.withManager(s.handleResume))
+	mux.HandleFunc("POST /fetch", s.withManager(s.handleFetch))
+	mux.HandleFunc("GET /log", s.withManager(s.handleLog))
+	s.server = &http.Server{Handler: mux}
+
+	return s
+}
+
+// Add registers the manager of a mount under name
+func (s *Server) Add(name string, manager *manager.Manager) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.managers[name] = manager
+}
+
+// Remove unregisters the mount with the given name
+func (s *Server) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.managers, name)
+}
+
+// names returns the sorted names of all registered mounts
+func (s *Server) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.managers))
+	for name := range s.managers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookup finds the manager selected by the request
+func (s *Server) lookup(r *http.Request) (*manager.Manager, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := r.URL.Query().Get("mount")
+	if name == "" {
+		if len(s.managers) == 1 {
+			for _, m := range s.managers {
+				return m, 0, nil
+			}
+		}
+		if len(s.managers) == 0 {
+			return nil, http.StatusNotFound, errors.New("no mounts")
+		}
+		return nil, http.StatusBadRequest, errors.New("multiple mounts, select one with the mount parameter")
+	}
+
+	m, ok := s.managers[name]
+	if !ok {
+		return nil, http.StatusNotFound, fmt.Errorf("unknown mount %s", name)
+	}
+	return m, 0, nil
+}
+
+type handlerFunc func(w http.ResponseWriter, r *http.Request, m *manager.Manager)
+
+func (s *Server) withManager(handler handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m, code, err := s.lookup(r)
+		if err != nil {
+			writeJSON(w, code, Result{Error: err.Error()})
+			return
+		}
+		handler(w, r, m)
+	}
+}
+
+// Listen creates the Unix socket at path, replacing a stale socket left
+// behind by a previous run
+func (s *Server) Listen(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return fmt.Errorf("control socket %s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("remove stale socket %s: %w", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", path, err)
+	}
+
+	// Only the owner of the mount should be able to control it
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("chmod %s: %w", path, err)
+	}
+
+	s.listener = listener
+	log.Printf("Control socket listening on %s", path)
+	return nil
+}
+
+// Serve serves requests until Close is called
+func (s *Server) Serve() error {
+	err := s.server.Serve(s.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close stops the server and removes the socket
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+func (s *Server) handleMounts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.names())
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request, m *manager.Manager) {
+	writeJSON(w, http.StatusOK, m.Status())
+}
+
+func (s *Server) handleSync(w http.ResponseWriter, r *http.Request, m *manager.Manager) {
+	writeResult(w, m.Sync())
+}
+
+func (s *Server) handleCommit(w http.ResponseWriter, r *http.Request, m *manager.Manager) {
+	var req CommitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, Result{Error: fmt.Sprintf("invalid request: %s", err)})
+		return
+	}
+	writeResult(w, m.Checkpoint(req.Message))
+}
+
+func (s *Server) handlePause(w http.ResponseWriter, r *http.Request, m *manager.Manager) {
+	m.Pause()
+	writeResult(w, nil)
+}
+
+func (s *Server) handleResume(w http.ResponseWriter, r *http.Request, m *manager.Manager) {
+	m.Resume()
+	writeResult(w, nil)
+}
+
+func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request, m *manager.Manager) {
+	writeResult(w, m.Fetch())
+}
+
+func (s *Server) handleLog(w http.ResponseWriter, r *http.Request, m *manager.Manager) {
+	n := 20
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, Result{Error: fmt.Sprintf("invalid n: %s", v)})
+			return
+		}
+	}
+
+	entries, err := m.Log(n)
+	if err != nil {
+		writeResult(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, Result{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, Result{OK: true})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing control response: %v", err)
+	}
+}
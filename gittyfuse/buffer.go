@@ -0,0 +1,152 @@
+package gittyfuse
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// SpillThreshold is the size above which the content of a file being
+// written is moved from memory to a temporary file in CacheDir
+var SpillThreshold int64 = 8 << 20
+
+// CacheDir is where spilled write buffers are kept, empty means the default
+// temporary directory
+var CacheDir string
+
+// writeBuffer holds the content of a file, small files are kept in memory
+// and big ones in a temporary file
+type writeBuffer struct {
+	data []byte
+	file *os.File
+	size int64
+}
+
+func newWriteBuffer(data []byte) *writeBuffer {
+	return &writeBuffer{data: data, size: int64(len(data))}
+}
+
+// Size returns the length of the content
+func (b *writeBuffer) Size() int64 {
+	return b.size
+}
+
+// ReadAt reads from the content like io.ReaderAt
+func (b *writeBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	if off+int64(len(p)) > b.size {
+		p = p[:b.size-off]
+	}
+
+	var n int
+	var err error
+	if b.file != nil {
+		n, err = b.file.ReadAt(p, off)
+	} else {
+		n = copy(p, b.data[off:])
+	}
+	if err == nil && off+int64(n) == b.size {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// WriteAt writes to the content, growing it as needed
+func (b *writeBuffer) WriteAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	if b.file == nil && end > SpillThreshold {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	if b.file != nil {
+		n, err := b.file.WriteAt(p, off)
+		if end := off + int64(n); end > b.size {
+			b.size = end
+		}
+		return n, err
+	}
+
+	if end > int64(cap(b.data)) {
+		// Grow by doubling so that sequential appends stay linear
+		newCap := 2 * int64(cap(b.data))
+		if newCap < end {
+			newCap = end
+		}
+		data := make([]byte, len(b.data), newCap)
+		copy(data, b.data)
+		b.data = data
+	}
+	if end > int64(len(b.data)) {
+		// Bytes between the old end and off read as zeros
+		clear(b.data[len(b.data):end])
+		b.data = b.data[:end]
+		b.size = end
+	}
+	return copy(b.data[off:], p), nil
+}
+
+// Truncate changes the size of the content, growing it with zeros
+func (b *writeBuffer) Truncate(size int64) error {
+	if b.file == nil && size > SpillThreshold {
+		if err := b.spill(); err != nil {
+			return err
+		}
+	}
+
+	if b.file != nil {
+		if err := b.file.Truncate(size); err != nil {
+			return err
+		}
+	} else if size <= int64(len(b.data)) {
+		b.data = b.data[:size]
+	} else {
+		data := make([]byte, size)
+		copy(data, b.data)
+		b.data = data
+	}
+
+	b.size = size
+	return nil
+}
+
+// Reader returns a reader of the whole content
+func (b *writeBuffer) Reader() io.Reader {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	return bytes.NewReader(b.data)
+}
+
+// Close removes the temporary file of a spilled buffer
+func (b *writeBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	err := os.Remove(b.file.Name())
+	b.file = nil
+	b.data = nil
+	b.size = 0
+	return err
+}
+
+// spill moves the content to a temporary file
+func (b *writeBuffer) spill() error {
+	file, err := os.CreateTemp(CacheDir, "gittyfs-buffer-")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(b.data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	b.file = file
+	b.data = nil
+	return nil
+}
@@ -0,0 +1,121 @@
+package gittyfuse
+
+import (
+	"context"
+	"log"
+	"math"
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// copyChunk is the most CopyFileRange copies byte by byte in one call, the
+// caller comes back for the rest
+const copyChunk = 4 << 20
+
+// CopyFileRange copies a range of the file to out. A file copied whole over
+// another one is copied in the worktree, so the copy is the same blob and its
+// content never passes through memory. Anything else is copied as a read and
+// a write.
+func (f *GittyFile) CopyFileRange(ctx context.Context, fhIn fs.FileHandle, offIn uint64, out *fs.Inode, fhOut fs.FileHandle, offOut uint64, length uint64, flags uint64) (uint32, syscall.Errno) {
+	if flags != 0 {
+		return 0, syscall.EINVAL
+	}
+	dst, ok := out.Operations().(*GittyFile)
+	if !ok {
+		return 0, syscall.ENOTSUP
+	}
+	if readOnly(dst.manager) {
+		return 0, syscall.EROFS
+	}
+
+	if dst != f && dst.wt == f.wt && offIn == 0 && offOut == 0 {
+		if n, ok, errno := f.copyWhole(dst, length); ok || errno != 0 {
+			return n, errno
+		}
+	}
+
+	buf := make([]byte, min(length, copyChunk))
+	res, errno := f.Read(ctx, fhIn, buf, int64(offIn))
+	if errno != 0 {
+		return 0, errno
+	}
+	data, status := res.Bytes(buf)
+	if !status.Ok() {
+		return 0, syscall.EIO
+	}
+	if len(data) == 0 {
+		return 0, 0
+	}
+	return dst.Write(ctx, fhOut, data, int64(offOut))
+}
+
+// copyWhole copies the file over dst in the worktree when length covers all
+// of it and dst is no longer. It reports false when the copy has to be made
+// byte by byte instead.
+func (f *GittyFile) copyWhole(dst *GittyFile, length uint64) (uint32, bool, syscall.Errno) {
+	f.mu.Lock()
+	// Changes that are not synced and LFS objects are not in the worktree
+	src, size := f.path, f.sizeLocked()
+	whole := !f.dirty && !f.unfetched && f.lfs == nil && length >= size && size <= math.MaxUint32
+	if info, err := f.wt.Stat(src); err != nil || uint64(info.Size()) != size {
+		whole = false
+	}
+	f.mu.Unlock()
+	if !whole {
+		return 0, false, 0
+	}
+
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+
+	if dst.sizeLocked() > size {
+		return 0, false, 0
+	}
+	if !dst.manager.FileSizeAllowed(int64(size)) {
+		log.Printf("Copy to %s exceeds the file size limit", dst.path)
+		return 0, true, syscall.EFBIG
+	}
+	if !dst.repoSizeAllowedLocked(int64(size)) {
+		log.Printf("Copy to %s exceeds the repository size limit", dst.path)
+		return 0, true, syscall.ENOSPC
+	}
+
+	// Files kept in Git LFS have to be written as pointers
+	paths := dst.pathsLocked()
+	for _, p := range paths {
+		if dst.manager.IsLFSPath(p) {
+			return 0, false, 0
+		}
+	}
+
+	for _, p := range paths {
+		// Keep the mode of dst, the copy only replaces its content
+		perm := os.FileMode(0644)
+		if info, err := dst.wt.Stat(p); err == nil {
+			perm = info.Mode().Perm()
+		}
+		if err := copyFile(dst.wt, src, p, perm); err != nil {
+			log.Printf("Error copying %s to %s: %v", src, p, err)
+			return 0, true, syscall.EIO
+		}
+	}
+
+	// Reads of dst go to the worktree copy from now on
+	if dst.loaded {
+		dst.content.Close()
+		dst.content = nil
+		dst.loaded = false
+	}
+	dst.closeSrcLocked()
+	dst.dirty = false
+	dst.lfs = nil
+	dst.unfetched = false
+	dst.size = int64(size)
+
+	for _, p := range paths {
+		dst.manager.NotifyChange(p, "write")
+	}
+	return uint32(size), true, 0
+}
@@ -15,14 +15,15 @@ package gittyfuse
 import (
 	"context"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/tryy3/gittyfs/manager"
@@ -36,57 +37,131 @@ type Filesystem struct {
 	wt          billy.Filesystem
 	manager     *manager.Manager
 	mountServer *fuse.Server
+	inodes      *inodeTable
 	UID         string
 	GID         string
+
+	// Subdir, when set, is the directory of the repository that is mounted
+	// instead of its root
+	Subdir string
+
+	// Sparse holds gitignore style patterns, when set only the paths they
+	// match are in the mount and the rest of the worktree is never read.
+	// Directories that can not hold a match are not even listed.
+	Sparse []string
 }
 
-func traverseTree(ctx context.Context, node *fs.Inode, wt billy.Filesystem, path string, manager *manager.Manager) {
-	fmt.Printf("Traversing tree at: %s\n", path)
+// traverseTree adds the worktree below path to node. When sparse is set
+// only the paths it matches are added, directories are kept if they match
+// or hold something that does and are not read if they can not.
+func traverseTree(ctx context.Context, node *fs.Inode, wt billy.Filesystem, path string, manager *manager.Manager, submodules map[string]bool, sparse *sparseFilter) {
 	files, err := wt.ReadDir(path)
 	if err != nil {
 		log.Fatalf("read dir: %s", err)
 	}
 
 	for _, file := range files {
-		if file.IsDir() {
-			filePath := filepath.Join(path, file.Name())
+		if node.IsRoot() && file.Name() == ControlDirName {
+			log.Printf("Hiding %s from the repository, the name is used for control files", ControlDirName)
+			continue
+		}
+
+		filePath := filepath.Join(path, file.Name())
+		elems := strings.Split(filePath, "/")
+		matched := sparse.Match(elems, file.IsDir())
+
+		if submodules[filePath] {
+			if !matched {
+				continue // There is no telling what is inside without a clone
+			}
+			// Submodules are cloned once they are first looked into
+			sub := NewGittySubmodule(filePath, manager)
+
+			subNode := node.NewPersistentInode(ctx, sub, stableAttr(node, file.Name(), syscall.S_IFDIR, nil, ""))
+			node.AddChild(file.Name(), subNode, true)
+		} else if file.IsDir() {
+			if !matched && !sparse.MayHold(elems) {
+				continue // Nothing below it is in the sparse mount
+			}
+
 			// Create a GittyDir for directories
 			dir := NewGittyDir(filePath, wt, manager)
-			fmt.Printf("Adding dir: %s\n", file.Name())
 
-			dirNode := node.NewPersistentInode(ctx, dir, fs.StableAttr{Mode: syscall.S_IFDIR})
+			dirNode := node.NewPersistentInode(ctx, dir, stableAttr(node, file.Name(), syscall.S_IFDIR, nil, ""))
 			node.AddChild(file.Name(), dirNode, true)
-			traverseTree(ctx, dirNode, wt, filepath.Join(path, file.Name()), manager)
-		} else {
-			filePath := filepath.Join(path, file.Name())
-			fmt.Printf("Adding file: %s\n", filePath)
-			gitFile, err := wt.OpenFile(filePath, os.O_RDONLY, 0)
-			if err != nil {
-				log.Fatalf("open file: %s", err)
-			}
-			defer gitFile.Close()
+			traverseTree(ctx, dirNode, wt, filePath, manager, submodules, sparse)
 
-			content, err := io.ReadAll(gitFile)
+			// Directories outside a sparse mount are only there for what
+			// they hold
+			if !matched && len(dirNode.Children()) == 0 {
+				node.RmChild(file.Name())
+			}
+		} else if !matched {
+			continue // Left out of the sparse mount
+		} else if isUnfetched(file) {
+			// Files of a partial clone are only fetched once opened
+			gittyFile := NewGittyPartialFile(filePath, wt, manager)
+			child := node.NewPersistentInode(ctx, gittyFile, stableAttr(node, file.Name(), syscall.S_IFREG, manager, filePath))
+			node.AddChild(file.Name(), child, true)
+		} else if streamed(wt, file.Size()) {
+			// Large files are streamed from the worktree instead of being
+			// copied into memory, they are too big to be LFS pointers
+			gittyFile := NewGittyStreamedFile(filePath, wt, manager, file.Size())
+			child := node.NewPersistentInode(ctx, gittyFile, stableAttr(node, file.Name(), syscall.S_IFREG, manager, filePath))
+			node.AddChild(file.Name(), child, true)
+		} else {
+			content, err := util.ReadFile(wt, filePath)
 			if err != nil {
 				log.Fatalf("read file: %s", err)
 			}
 
-			// create a GittyFile for handling file operations
+			// create a GittyFile for handling file operations, files in Git
+			// LFS are only fetched once they are opened
 			gittyFile := NewGittyFileWithContent(filePath, wt, manager, content)
+			if pointer, ok := manager.LFSPointer(filePath, content); ok {
+				gittyFile = NewGittyLFSFile(filePath, wt, manager, pointer)
+			}
 
-			child := node.NewPersistentInode(ctx, gittyFile, fs.StableAttr{})
+			child := node.NewPersistentInode(ctx, gittyFile, stableAttr(node, file.Name(), syscall.S_IFREG, manager, filePath))
 			node.AddChild(file.Name(), child, true)
 		}
 	}
+}
 
-	fmt.Printf("node: %v\n", node)
+// streamed reports whether a file of size is read from the worktree once it
+// is opened instead of when mounting. A worktree that was never checked out
+// keeps its files in the object store, only what may be an LFS pointer is
+// read up front.
+func streamed(wt billy.Filesystem, size int64) bool {
+	if _, ok := wt.(*manager.TreeFS); ok {
+		return size > manager.LFSMaxPointerSize
+	}
+	return size > StreamThreshold
+}
+
+// isUnfetched reports whether file is in a partial clone and its blob was not
+// fetched yet
+func isUnfetched(file os.FileInfo) bool {
+	_, ok := file.Sys().(manager.UnfetchedBlob)
+	return ok
 }
 
 func (self *Filesystem) OnAdd(ctx context.Context) {
-	traverseTree(ctx, &self.Inode, self.wt, "", self.manager)
+	sparse := newSparseFilter(self.Sparse)
+	traverseTree(ctx, &self.Inode, self.wt, self.GittyDir.path, self.manager, self.manager.SubmodulePaths(), sparse)
+	addControlDir(ctx, &self.Inode, self.manager)
 }
 
-func (self *Filesystem) Mount(path string) {
+func (self *Filesystem) Mount(path string) error {
+	if self.Subdir != "" {
+		subdir := strings.Trim(filepath.ToSlash(filepath.Clean(self.Subdir)), "/")
+		info, err := self.wt.Stat(subdir)
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("subdir %s is not a directory of the repository", self.Subdir)
+		}
+		self.GittyDir.path = subdir
+	}
+
 	// Get current user's UID and GID
 	var err error
 	var uid int
@@ -94,7 +169,7 @@ func (self *Filesystem) Mount(path string) {
 	if self.UID != "" {
 		uid, err = strconv.Atoi(self.UID)
 		if err != nil {
-			log.Fatalf("invalid uid: %s", self.UID)
+			return fmt.Errorf("invalid uid: %s", self.UID)
 		}
 	} else {
 		uid = os.Getuid()
@@ -102,34 +177,46 @@ func (self *Filesystem) Mount(path string) {
 	if self.GID != "" {
 		gid, err = strconv.Atoi(self.GID)
 		if err != nil {
-			log.Fatalf("invalid gid: %s", self.GID)
+			return fmt.Errorf("invalid gid: %s", self.GID)
 		}
 	} else {
 		gid = os.Getgid()
 	}
 
+	mountOptions := fuse.MountOptions{
+		AllowOther:  true,
+		Debug:       true,
+		EnableLocks: true,
+	}
+	if readOnly(self.manager) {
+		mountOptions.Options = append(mountOptions.Options, "ro")
+	}
+
 	server, err := fs.Mount(path, self, &fs.Options{
 		// Set proper ownership
 		UID: uint32(uid),
 		GID: uint32(gid),
 
-		MountOptions: fuse.MountOptions{
-			AllowOther: true,
-			Debug:      true,
-		},
+		MountOptions: mountOptions,
 	})
+	if err != nil {
+		return fmt.Errorf("mount %s: %w", path, err)
+	}
 
 	self.mountServer = server
 	log.Printf("Mounted on %s", path)
-	log.Printf("Unmount by calling 'fusermount -u %s'", path)
+	log.Printf("Unmount by calling 'gittyfs unmount %s'", path)
 
-	if err != nil {
-		log.Panic(err)
-	}
+	return nil
+}
+
+func (self *Filesystem) Unmount() error {
+	return self.mountServer.Unmount()
 }
 
-func (self *Filesystem) Unmount() {
-	self.mountServer.Unmount()
+// Wait blocks until the filesystem is unmounted
+func (self *Filesystem) Wait() {
+	self.mountServer.Wait()
 }
 
 func NewFilesystem(wt billy.Filesystem, manager *manager.Manager, UID, GID string) *Filesystem {
@@ -139,7 +226,53 @@ func NewFilesystem(wt billy.Filesystem, manager *manager.Manager, UID, GID strin
 		GittyDir: dir,
 		wt:       wt,
 		manager:  manager,
+		inodes:   newInodeTable(),
 		UID:      UID,
 		GID:      GID,
 	}
 }
+
+// statfsBlockSize is the block size the mount reports
+const statfsBlockSize = 4096
+
+// statfs reports the worktree of m as the used part of the mount. The free
+// part is what is left below the repository size limit, without one it is
+// the free space of the cache dir that large writes spill to.
+func statfs(m *manager.Manager, out *fuse.StatfsOut) syscall.Errno {
+	if m == nil {
+		return 0
+	}
+
+	usage := m.Usage()
+	used := uint64((usage.Bytes + statfsBlockSize - 1) / statfsBlockSize)
+
+	var free uint64
+	if max := m.MaxRepoSize(); max > 0 {
+		if total := uint64(max / statfsBlockSize); total > used {
+			free = total - used
+		}
+	} else {
+		dir := CacheDir
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err != nil {
+			log.Printf("Error reading the free space of %s: %v", dir, err)
+		} else {
+			free = uint64(st.Bavail) * uint64(st.Bsize) / statfsBlockSize
+		}
+	}
+
+	out.Bsize = statfsBlockSize
+	out.Frsize = statfsBlockSize
+	out.Blocks = used + free
+	out.Bfree = free
+	out.Bavail = free
+	// There is no limit on the number of files, one per free block is
+	// reported like most filesystems do
+	out.Files = uint64(usage.Files) + free
+	out.Ffree = free
+	out.NameLen = 255
+	return 0
+}
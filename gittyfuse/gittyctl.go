@@ -0,0 +1,205 @@
+package gittyfuse
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/tryy3/gittyfs/manager"
+)
+
+// ControlDirName is the name of the virtual directory in the root of the
+// mount holding the control files, it only exists in the mount and is never
+// committed
+const ControlDirName = ".gitty"
+
+// controlKind identifies what a control file does
+type controlKind int
+
+const (
+	// controlStatus is read-only and contains the manager status as JSON
+	controlStatus controlKind = iota
+	// controlSync starts a sync when written to
+	controlSync
+	// controlMessage holds the message used for the next commit
+	controlMessage
+)
+
+var controlFiles = map[string]controlKind{
+	"status":  controlStatus,
+	"sync":    controlSync,
+	"message": controlMessage,
+}
+
+// GittyControlDir is the virtual .gitty directory
+type GittyControlDir struct {
+	fs.Inode
+}
+
+var _ = (fs.NodeGetattrer)((*GittyControlDir)(nil))
+
+func (d *GittyControlDir) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0555
+	out.Nlink = 2
+	t := time.Now()
+	out.SetTimes(&t, &t, &t)
+	return 0
+}
+
+// GittyControlFile is a virtual file used to talk to the manager from
+// inside the mount
+type GittyControlFile struct {
+	fs.Inode
+	kind    controlKind
+	manager *manager.Manager
+}
+
+var _ = (fs.NodeOpener)((*GittyControlFile)(nil))
+var _ = (fs.NodeGetattrer)((*GittyControlFile)(nil))
+var _ = (fs.NodeSetattrer)((*GittyControlFile)(nil))
+
+// addControlDir adds the .gitty directory and its files below root
+func addControlDir(ctx context.Context, root *fs.Inode, manager *manager.Manager) {
+	dir := root.NewPersistentInode(ctx, &GittyControlDir{}, stableAttr(root, ControlDirName, syscall.S_IFDIR, nil, ""))
+	root.AddChild(ControlDirName, dir, true)
+
+	for name, kind := range controlFiles {
+		file := &GittyControlFile{kind: kind, manager: manager}
+		dir.AddChild(name, dir.NewPersistentInode(ctx, file, stableAttr(dir, name, syscall.S_IFREG, nil, "")), true)
+	}
+}
+
+// content returns what reading the file currently yields
+func (f *GittyControlFile) content() []byte {
+	switch f.kind {
+	case controlStatus:
+		data, err := json.MarshalIndent(f.manager.Status(), "", "  ")
+		if err != nil {
+			log.Printf("Error encoding status: %v", err)
+			return nil
+		}
+		return append(data, '\n')
+	case controlMessage:
+		if message := f.manager.CommitMessage(); message != "" {
+			return []byte(message + "\n")
+		}
+	}
+	return nil
+}
+
+func (f *GittyControlFile) mode() uint32 {
+	switch f.kind {
+	case controlStatus:
+		return 0444
+	case controlSync:
+		return 0200
+	default:
+		return 0644
+	}
+}
+
+func (f *GittyControlFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = f.mode()
+	out.Size = uint64(len(f.content()))
+	t := time.Now()
+	out.SetTimes(&t, &t, &t)
+	return 0
+}
+
+// Setattr accepts truncation so that shell redirection works, everything
+// else is ignored
+func (f *GittyControlFile) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if f.kind == controlStatus && in.Valid&fuse.FATTR_SIZE != 0 {
+		return syscall.EACCES
+	}
+	return f.Getattr(ctx, fh, out)
+}
+
+func (f *GittyControlFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	write := flags&syscall.O_ACCMODE != syscall.O_RDONLY
+	if write && f.kind == controlStatus {
+		return nil, 0, syscall.EACCES
+	}
+	if !write && f.kind == controlSync {
+		return nil, 0, syscall.EACCES
+	}
+
+	// Reads are served from a snapshot taken at open, direct IO makes the
+	// kernel ignore the size reported by Getattr which may change meanwhile
+	handle := &controlHandle{file: f, data: f.content()}
+
+	// Opening the message with O_TRUNC and closing it again clears it
+	if write && flags&syscall.O_TRUNC != 0 {
+		handle.dirty = true
+	}
+
+	return handle, fuse.FOPEN_DIRECT_IO, 0
+}
+
+// controlHandle is an open control file
+type controlHandle struct {
+	mu      sync.Mutex
+	file    *GittyControlFile
+	data    []byte
+	written []byte
+	dirty   bool
+}
+
+var _ = (fs.FileReader)((*controlHandle)(nil))
+var _ = (fs.FileWriter)((*controlHandle)(nil))
+var _ = (fs.FileFlusher)((*controlHandle)(nil))
+
+func (h *controlHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if off >= int64(len(h.data)) {
+		return fuse.ReadResultData([]byte{}), 0
+	}
+
+	end := off + int64(len(dest))
+	if end > int64(len(h.data)) {
+		end = int64(len(h.data))
+	}
+
+	return fuse.ReadResultData(h.data[off:end]), 0
+}
+
+func (h *controlHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch h.file.kind {
+	case controlSync:
+		// Whatever is written, the write itself is the trigger. The sync
+		// runs in the background, the result shows up in the status file.
+		h.file.manager.RequestSync()
+	case controlMessage:
+		// The message is set once the writer closes the file
+		if int64(len(h.written)) < off+int64(len(data)) {
+			newSlice := make([]byte, off+int64(len(data)))
+			copy(newSlice, h.written)
+			h.written = newSlice
+		}
+		copy(h.written[off:], data)
+		h.dirty = true
+	}
+
+	return uint32(len(data)), 0
+}
+
+func (h *controlHandle) Flush(ctx context.Context) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.file.kind == controlMessage && h.dirty {
+		h.file.manager.SetCommitMessage(string(h.written))
+		h.dirty = false
+	}
+	return 0
+}
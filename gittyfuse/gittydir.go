@@ -3,14 +3,17 @@ package gittyfuse
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
-	"strings"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/tryy3/gittyfs/manager"
@@ -31,6 +34,9 @@ var _ = (fs.NodeUnlinker)((*GittyDir)(nil))
 var _ = (fs.NodeGetattrer)((*GittyDir)(nil))
 var _ = (fs.NodeRenamer)((*GittyDir)(nil))
 var _ = (fs.NodeMkdirer)((*GittyDir)(nil))
+var _ = (fs.NodeStatfser)((*GittyDir)(nil))
+var _ = (fs.NodeOnForgetter)((*GittyDir)(nil))
+var _ = (fs.NodeLinker)((*GittyDir)(nil))
 
 func NewGittyDir(path string, wt billy.Filesystem, manager *manager.Manager) *GittyDir {
 	return &GittyDir{
@@ -40,10 +46,29 @@ func NewGittyDir(path string, wt billy.Filesystem, manager *manager.Manager) *Gi
 	}
 }
 
+// hidden reports whether p, which is not in the mount, is in the worktree.
+// Paths left out of a sparse mount must not be overwritten by new ones.
+func (d *GittyDir) hidden(p string) bool {
+	_, err := d.wt.Lstat(p)
+	return err == nil
+}
+
+// readOnly reports whether writes to the mount are refused
+func readOnly(m *manager.Manager) bool {
+	return m != nil && m.ReadOnly()
+}
+
 // Create creates a new file in the directory
 func (d *GittyDir) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	log.Printf("Create: %s", name)
+	if readOnly(d.manager) {
+		return nil, nil, 0, syscall.EROFS
+	}
 	path := filepath.Join(d.path, name)
+	if d.hidden(path) {
+		log.Printf("Not creating %s, it is left out of the mount", path)
+		return nil, nil, 0, syscall.EEXIST
+	}
 
 	// Create an empty GittyFile
 	gfile := NewGittyFile(path, d.wt, d.manager)
@@ -57,7 +82,7 @@ func (d *GittyDir) Create(ctx context.Context, name string, flags uint32, mode u
 	defer file.Close()
 
 	// Create the child node
-	child := d.NewPersistentInode(ctx, gfile, fs.StableAttr{})
+	child := d.NewPersistentInode(ctx, gfile, stableAttr(&d.Inode, name, syscall.S_IFREG, nil, ""))
 	d.AddChild(name, child, true)
 
 	// Setup entry attributes
@@ -115,6 +140,9 @@ func (d *GittyDir) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.Attr
 
 func (d *GittyDir) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
 	log.Printf("Setattr on directory: %s", d.path)
+	if readOnly(d.manager) {
+		return syscall.EROFS
+	}
 
 	// Check what attributes are being set
 	valid := in.Valid
@@ -184,6 +212,9 @@ func (d *GittyDir) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAt
 func (d *GittyDir) Unlink(ctx context.Context, name string) syscall.Errno {
 	path := filepath.Join(d.path, name)
 	log.Printf("Unlink: %s", path)
+	if readOnly(d.manager) {
+		return syscall.EROFS
+	}
 
 	// Remove from the billy filesystem
 	err := d.wt.Remove(path)
@@ -195,6 +226,14 @@ func (d *GittyDir) Unlink(ctx context.Context, name string) syscall.Errno {
 		return syscall.EIO
 	}
 
+	// A file that is hard linked lives on under its other names, otherwise
+	// the node goes once the kernel is done with it
+	if child := d.GetChild(name); child != nil {
+		if file, ok := child.Operations().(*GittyFile); !ok || !file.dropPath(path) {
+			child.ForgetPersistent()
+		}
+	}
+
 	// Remove the child from the inode
 	d.Inode.RmChild(name)
 
@@ -210,6 +249,9 @@ func (d *GittyDir) Unlink(ctx context.Context, name string) syscall.Errno {
 func (d *GittyDir) Rmdir(ctx context.Context, name string) syscall.Errno {
 	path := filepath.Join(d.path, name)
 	log.Printf("Rmdir: %s", path)
+	if readOnly(d.manager) {
+		return syscall.EROFS
+	}
 
 	// Check if directory exists and is empty
 	entries, err := d.wt.ReadDir(path)
@@ -234,7 +276,11 @@ func (d *GittyDir) Rmdir(ctx context.Context, name string) syscall.Errno {
 		return syscall.EIO
 	}
 
-	// Remove the child from the inode
+	// Remove the child from the inode, it goes once the kernel is done
+	// with it
+	if child := d.GetChild(name); child != nil {
+		child.ForgetPersistent()
+	}
 	d.Inode.RmChild(name)
 
 	// Notify manager about the deletion
@@ -245,99 +291,206 @@ func (d *GittyDir) Rmdir(ctx context.Context, name string) syscall.Errno {
 	return 0
 }
 
-func (d *GittyDir) findFile(p string) *fs.Inode {
-	// First traverse up to the parent directory
-	var traverseUp func(node *fs.Inode) *fs.Inode
-	traverseUp = func(node *fs.Inode) *fs.Inode {
-		if node.IsRoot() {
-			return node
-		}
-		f, parent := node.Parent()
-		fmt.Printf("Test: %#v\n", f)
-		return traverseUp(parent)
-	}
-	parent := traverseUp(&d.Inode)
-	fmt.Printf("%#v\n", parent)
-
-	// Get filename from path
-	pathSplit := strings.Split(p, string(os.PathSeparator))
-	for _, v := range pathSplit {
-		// look in directory
-		children := parent.Children()
-		for name, child := range children {
-			fmt.Printf("Name: %#v\n", name)
-			if name == v {
-				fmt.Printf("Found: %#v\n", child)
-				parent = child
-				break
+// renameNoReplace is the renameat2 flag that refuses to replace the target,
+// go-fuse only has RENAME_EXCHANGE
+const renameNoReplace = 0x1
+
+// gittyDirOf returns the GittyDir of a directory node, nil for the control
+// directory
+func gittyDirOf(node fs.InodeEmbedder) *GittyDir {
+	switch n := node.(type) {
+	case *GittyDir:
+		return n
+	case *Filesystem:
+		return n.GittyDir
+	case *GittySubmodule:
+		return &n.GittyDir
+	}
+	return nil
+}
+
+// movable checks that node can be renamed. Submodules are recorded in the
+// parent tree by path, so neither they nor directories holding them move.
+func movable(node *fs.Inode) syscall.Errno {
+	switch node.Operations().(type) {
+	case *GittyFile:
+		return 0
+	case *GittyDir:
+		for _, child := range node.Children() {
+			if errno := movable(child); errno != 0 {
+				return errno
 			}
 		}
+		return 0
+	case *GittySubmodule:
+		return syscall.EBUSY
 	}
+	return syscall.EPERM
+}
 
-	return parent
+// setPath points node and everything below it from oldPath to newPath after
+// a rename
+func setPath(node *fs.Inode, oldPath, newPath string) {
+	switch n := node.Operations().(type) {
+	case *GittyFile:
+		n.movePath(oldPath, newPath)
+	case *GittyDir:
+		n.path = newPath
+		for name, child := range node.Children() {
+			setPath(child, filepath.Join(oldPath, name), filepath.Join(newPath, name))
+		}
+	}
 }
 
-// Rename implements the NodeRenamer interface for GittyDir
+// Rename implements the NodeRenamer interface for GittyDir. The inodes are
+// moved by go-fuse once this returns, only the paths have to follow.
 func (d *GittyDir) Rename(ctx context.Context, oldName string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
 	log.Printf("Rename directory entry: %s -> %s", oldName, newName)
+	if readOnly(d.manager) {
+		return syscall.EROFS
+	}
+
+	target := gittyDirOf(newParent)
+	if target == nil {
+		return syscall.EPERM
+	}
+	if target.manager != d.manager {
+		// Moving in or out of a submodule changes repository
+		return syscall.EXDEV
+	}
 
-	// Old path, new path
 	oldPath := filepath.Join(d.path, oldName)
-	log.Printf("%#v\n", oldPath)
-
-	var newParentPath string
-	var newPath string
-
-	if dir, ok := newParent.(*GittyDir); ok {
-		log.Printf("%#v\n", dir)
-		log.Println("Directory")
-		newParentPath = dir.path
-		newPath = filepath.Join(newParentPath, newName)
-	} else if file, ok := newParent.(*GittyFile); ok {
-		log.Printf("%#v\n", file)
-		log.Println("File")
-	} else {
-		log.Println("Unknown")
-		return syscall.EIO
+	newPath := filepath.Join(target.path, newName)
+
+	child := d.GetChild(oldName)
+	if child == nil {
+		return syscall.ENOENT
+	}
+	if errno := movable(child); errno != 0 {
+		return errno
 	}
 
-	log.Printf("%#v\n", newParentPath)
-	err := d.wt.Rename(oldPath, newPath)
-	if err != nil {
-		log.Printf("Error renaming directory %s: %v", oldPath, err)
-		return syscall.EIO
+	existing := target.GetChild(newName)
+	if existing == nil && target.hidden(newPath) {
+		log.Printf("Not renaming onto %s, it is left out of the mount", newPath)
+		return syscall.EEXIST
 	}
 
-	log.Printf("%#v\n", newPath)
-	// Retrieve current file
-	oldFile := d.findFile(oldPath)
+	if flags&fs.RENAME_EXCHANGE != 0 {
+		if existing == nil {
+			return syscall.ENOENT
+		}
+		if errno := movable(existing); errno != 0 {
+			return errno
+		}
+		if errno := d.exchange(oldPath, newPath); errno != 0 {
+			return errno
+		}
 
-	// Forget the old file
-	_, oldParentDir := oldFile.Parent()
-	ok, _ := oldParentDir.RmChild(oldName)
-	if !ok {
-		log.Printf("Error removing child %s", oldName)
-		return syscall.EIO
+		setPath(child, oldPath, newPath)
+		setPath(existing, newPath, oldPath)
+		if d.manager != nil {
+			d.manager.NotifyChange(oldPath, "exchange")
+			d.manager.NotifyChange(newPath, "exchange")
+		}
+		return 0
 	}
 
-	// Add the new file
-	ok = newParent.EmbeddedInode().AddChild(newName, oldFile, true)
-	if !ok {
-		log.Printf("Error adding child %s", newName)
+	if existing != nil {
+		if flags&renameNoReplace != 0 {
+			return syscall.EEXIST
+		}
+		if errno := d.replaceable(child, existing, newPath); errno != 0 {
+			return errno
+		}
+		if err := d.wt.Remove(newPath); err != nil {
+			log.Printf("Error removing %s: %v", newPath, err)
+			return syscall.EIO
+		}
+		if file, ok := existing.Operations().(*GittyFile); !ok || !file.dropPath(newPath) {
+			existing.ForgetPersistent()
+		}
+	}
+
+	if err := renamePath(d.wt, oldPath, newPath); err != nil {
+		log.Printf("Error renaming %s to %s: %v", oldPath, newPath, err)
 		return syscall.EIO
 	}
 
-	// Notify manager about deleting oldPath and creating newPath
-	d.manager.NotifyChange(oldPath, "delete")
-	d.manager.NotifyChange(newPath, "create")
+	setPath(child, oldPath, newPath)
+	if d.manager != nil {
+		d.manager.NotifyRename(oldPath, newPath)
+	}
+	return 0
+}
+
+// replaceable checks that child may replace existing, which is at p, the
+// way rename(2) does
+func (d *GittyDir) replaceable(child, existing *fs.Inode, p string) syscall.Errno {
+	if errno := movable(existing); errno != 0 {
+		return errno
+	}
+	if child.IsDir() && !existing.IsDir() {
+		return syscall.ENOTDIR
+	}
+	if !child.IsDir() && existing.IsDir() {
+		return syscall.EISDIR
+	}
+	if existing.IsDir() {
+		// Paths left out of a sparse mount count as well
+		entries, err := d.wt.ReadDir(p)
+		if err != nil {
+			log.Printf("Error reading directory %s: %v", p, err)
+			return syscall.EIO
+		}
+		if len(entries) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+	return 0
+}
 
+// exchange swaps a and b in the worktree
+func (d *GittyDir) exchange(a, b string) syscall.Errno {
+	tmp, err := d.freeName(filepath.Dir(b), ".gittyfs-exchange-")
+	if err != nil {
+		log.Printf("Error exchanging %s and %s: %v", a, b, err)
+		return syscall.EIO
+	}
+	for _, step := range [][2]string{{a, tmp}, {b, a}, {tmp, b}} {
+		if err := renamePath(d.wt, step[0], step[1]); err != nil {
+			log.Printf("Error exchanging %s and %s: %v", a, b, err)
+			return syscall.EIO
+		}
+	}
 	return 0
 }
 
+// freeName returns a path in dir starting with prefix that nothing in the
+// worktree uses, not even what is left out of the mount
+func (d *GittyDir) freeName(dir, prefix string) (string, error) {
+	for i := 0; i < 100; i++ {
+		p := filepath.Join(dir, prefix+strconv.FormatUint(rand.Uint64(), 36))
+		if _, err := d.wt.Lstat(p); os.IsNotExist(err) {
+			return p, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no free name in %s", dir)
+}
+
 // Mkdir implements the NodeMkdirer interface for creating directories
 func (d *GittyDir) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
 	path := filepath.Join(d.path, name)
 	log.Printf("Mkdir: %s with mode %o", path, mode)
+	if readOnly(d.manager) {
+		return nil, syscall.EROFS
+	}
+	if d.hidden(path) {
+		log.Printf("Not creating %s, it is left out of the mount", path)
+		return nil, syscall.EEXIST
+	}
 
 	// Create the directory in the underlying filesystem
 	err := d.wt.MkdirAll(path, os.FileMode(mode))
@@ -350,7 +503,7 @@ func (d *GittyDir) Mkdir(ctx context.Context, name string, mode uint32, out *fus
 	newDir := NewGittyDir(path, d.wt, d.manager)
 
 	// Create a persistent inode for the new directory
-	child := d.NewPersistentInode(ctx, newDir, fs.StableAttr{Mode: syscall.S_IFDIR})
+	child := d.NewPersistentInode(ctx, newDir, stableAttr(&d.Inode, name, syscall.S_IFDIR, nil, ""))
 
 	// Add the new directory as a child of this directory
 	d.AddChild(name, child, true)
@@ -376,3 +529,89 @@ func (d *GittyDir) Mkdir(ctx context.Context, name string, mode uint32, out *fus
 	log.Printf("Successfully created directory: %s", path)
 	return child, 0
 }
+
+// renamePath renames from to to in wt. memfs moves every path that starts
+// with from along with it, a.txt goes too when a is renamed, so on memfs the
+// files are moved one by one instead.
+func renamePath(wt billy.Filesystem, from, to string) error {
+	if !isMemfs(wt) {
+		return wt.Rename(from, to)
+	}
+
+	info, err := wt.Lstat(from)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := wt.Readlink(from)
+		if err != nil {
+			return err
+		}
+		if err := wt.Symlink(target, to); err != nil {
+			return err
+		}
+	case info.IsDir():
+		if err := wt.MkdirAll(to, info.Mode().Perm()); err != nil {
+			return err
+		}
+		entries, err := wt.ReadDir(from)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := renamePath(wt, filepath.Join(from, entry.Name()), filepath.Join(to, entry.Name())); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := copyFile(wt, from, to, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return wt.Remove(from)
+}
+
+// isMemfs reports whether wt is a memfs, which comes wrapped in helpers
+func isMemfs(wt billy.Filesystem) bool {
+	var fs billy.Basic = wt
+	for {
+		switch helper := fs.(type) {
+		case *memfs.Memory:
+			return true
+		case interface{ Underlying() billy.Basic }:
+			fs = helper.Underlying()
+		default:
+			return false
+		}
+	}
+}
+
+func copyFile(wt billy.Filesystem, from, to string, perm os.FileMode) error {
+	src, err := wt.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := wt.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// OnForget releases the inode number of a directory that was removed
+func (d *GittyDir) OnForget() {
+	releaseNode(&d.Inode)
+}
+
+// Statfs reports the capacity of the mount
+func (d *GittyDir) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return statfs(d.manager, out)
+}
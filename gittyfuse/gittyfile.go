@@ -2,9 +2,9 @@ package gittyfuse
 
 import (
 	"context"
+	"io"
 	"log"
 	"os"
-	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
@@ -15,42 +15,250 @@ import (
 	"github.com/tryy3/gittyfs/manager"
 )
 
+// StreamThreshold is the size above which files are not read into memory
+// when mounting, reads of them are served from the worktree or the LFS object
+// store until they are written to
+var StreamThreshold int64 = 1 << 20
+
 // GittyFile implements a file with better write support
 type GittyFile struct {
 	fs.Inode
 	mu      sync.Mutex
-	content []byte
+	content *writeBuffer
 	path    string
 	wt      billy.Filesystem
 	dirty   bool
 	manager *manager.Manager
+
+	// loaded is false while content has not been read, reads are then
+	// streamed from src which is open while the file is. Content is only
+	// read once the file is changed and dropped again once it is synced.
+	loaded bool
+	size   int64
+	src    readerAtCloser
+	opens  int
+
+	// lfs is set for files kept in Git LFS, their content is fetched on
+	// the first open
+	lfs *manager.LFSPointer
+
+	// partial is set for files of a partial clone that were not fetched
+	// when mounted, their size is unknown until the first open so they
+	// are read with direct I/O
+	partial   bool
+	unfetched bool
+
+	// locks are the advisory locks held on the file, lockWait is closed
+	// when some are released. lockedPath is the path the manager was told
+	// is write locked.
+	locks      []fileLock
+	lockWait   chan struct{}
+	lockedPath string
+
+	// links are the other names of a file that is hard linked, each is
+	// written to the worktree along with path
+	links []string
+}
+
+// fileHandle is the handle of an open file
+type fileHandle struct {
+	// append is set for files opened with O_APPEND, writes then go to the
+	// end of the content whatever offset the kernel asks for. The kernel
+	// works the offset out from the size it last saw, which is zero for
+	// files of a partial clone until their attributes are refreshed.
+	append bool
+}
+
+type readerAtCloser interface {
+	io.ReaderAt
+	io.Closer
 }
 
 // Ensure it implements the right interfaces
 var _ = (fs.NodeOpener)((*GittyFile)(nil))
+var _ = (fs.NodeReader)((*GittyFile)(nil))
 var _ = (fs.NodeWriter)((*GittyFile)(nil))
+var _ = (fs.NodeReleaser)((*GittyFile)(nil))
 var _ = (fs.NodeFsyncer)((*GittyFile)(nil))
 var _ = (fs.NodeGetattrer)((*GittyFile)(nil))
 var _ = (fs.NodeSetattrer)((*GittyFile)(nil))
 var _ = (fs.NodeUnlinker)((*GittyFile)(nil))
-var _ = (fs.NodeRenamer)((*GittyFile)(nil))
+var _ = (fs.NodeStatfser)((*GittyFile)(nil))
+var _ = (fs.NodeOnForgetter)((*GittyFile)(nil))
+var _ = (fs.NodeGetlker)((*GittyFile)(nil))
+var _ = (fs.NodeSetlker)((*GittyFile)(nil))
+var _ = (fs.NodeSetlkwer)((*GittyFile)(nil))
+var _ = (fs.NodeCopyFileRanger)((*GittyFile)(nil))
+var _ = (fs.NodeAllocater)((*GittyFile)(nil))
 
 func NewGittyFile(path string, wt billy.Filesystem, manager *manager.Manager) *GittyFile {
 	return &GittyFile{
-		content: []byte{},
+		content: newWriteBuffer(nil),
 		path:    path,
 		wt:      wt,
 		manager: manager,
+		loaded:  true,
 	}
 }
 
 func NewGittyFileWithContent(path string, wt billy.Filesystem, manager *manager.Manager, content []byte) *GittyFile {
 	return &GittyFile{
-		content: content,
+		content: newWriteBuffer(content),
+		path:    path,
+		wt:      wt,
+		manager: manager,
+		loaded:  true,
+	}
+}
+
+// NewGittyStreamedFile creates a file whose content stays in the worktree
+// until it is written to
+func NewGittyStreamedFile(path string, wt billy.Filesystem, manager *manager.Manager, size int64) *GittyFile {
+	return &GittyFile{
+		path:    path,
+		wt:      wt,
+		manager: manager,
+		size:    size,
+	}
+}
+
+// NewGittyPartialFile creates a file of a partial clone whose blob is
+// fetched on the first open
+func NewGittyPartialFile(path string, wt billy.Filesystem, manager *manager.Manager) *GittyFile {
+	return &GittyFile{
+		path:      path,
+		wt:        wt,
+		manager:   manager,
+		partial:   true,
+		unfetched: true,
+	}
+}
+
+// NewGittyLFSFile creates a file whose content is fetched from Git LFS
+func NewGittyLFSFile(path string, wt billy.Filesystem, manager *manager.Manager, pointer manager.LFSPointer) *GittyFile {
+	return &GittyFile{
 		path:    path,
 		wt:      wt,
 		manager: manager,
+		size:    pointer.Size,
+		lfs:     &pointer,
+	}
+}
+
+// openSrcLocked opens where the content of a file that is not loaded is
+// read from, fetching LFS objects if needed
+func (f *GittyFile) openSrcLocked(ctx context.Context) syscall.Errno {
+	if f.loaded || f.src != nil {
+		return 0
+	}
+
+	var err error
+	if f.lfs != nil {
+		f.src, err = f.manager.OpenLFS(ctx, *f.lfs)
+	} else {
+		f.src, err = f.wt.Open(f.path)
+		if err == nil && f.unfetched {
+			err = f.fetchedLocked(ctx)
+		}
+	}
+	if err != nil {
+		log.Printf("Error opening content of %s: %v", f.path, err)
+		return syscall.EIO
 	}
+	return 0
+}
+
+// fetchedLocked finds the size of a file of a partial clone once its blob
+// was fetched, Git LFS pointers can only be told apart at this point
+func (f *GittyFile) fetchedLocked(ctx context.Context) error {
+	info, err := f.wt.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.size = info.Size()
+	f.unfetched = false
+
+	if f.size > 1024 {
+		return nil // Too big for a pointer
+	}
+	content := make([]byte, f.size)
+	if _, err := f.src.ReadAt(content, 0); err != nil && err != io.EOF {
+		return err
+	}
+	pointer, ok := f.manager.LFSPointer(f.path, content)
+	if !ok {
+		return nil
+	}
+
+	f.src.Close()
+	f.lfs = &pointer
+	f.size = pointer.Size
+	f.src, err = f.manager.OpenLFS(ctx, pointer)
+	return err
+}
+
+func (f *GittyFile) closeSrcLocked() {
+	if f.src != nil {
+		f.src.Close()
+		f.src = nil
+	}
+}
+
+// loadLocked copies the content into a write buffer so that it can be
+// changed
+func (f *GittyFile) loadLocked(ctx context.Context) syscall.Errno {
+	if f.loaded {
+		return 0
+	}
+	if errno := f.openSrcLocked(ctx); errno != 0 {
+		return errno
+	}
+
+	content := newWriteBuffer(nil)
+	_, err := io.Copy(io.NewOffsetWriter(content, 0), io.NewSectionReader(f.src, 0, f.size))
+	if err != nil {
+		content.Close()
+		log.Printf("Error reading content of %s: %v", f.path, err)
+		return syscall.EIO
+	}
+
+	f.content = content
+	f.loaded = true
+	f.closeSrcLocked()
+	return 0
+}
+
+// unloadLocked drops the write buffer of a synced file, reads go back to
+// the worktree or the LFS object store
+func (f *GittyFile) unloadLocked() {
+	if !f.loaded || f.dirty {
+		return
+	}
+	f.size = f.content.Size()
+	f.content.Close()
+	f.content = nil
+	f.loaded = false
+}
+
+// sizeLocked returns the size of the file content
+func (f *GittyFile) sizeLocked() uint64 {
+	if !f.loaded {
+		return uint64(f.size)
+	}
+	return uint64(f.content.Size())
+}
+
+// repoSizeAllowedLocked reports whether the file may grow to size. It only
+// reaches the worktree once synced, so growth counts from its size there.
+func (f *GittyFile) repoSizeAllowedLocked(size int64) bool {
+	if f.manager.MaxRepoSize() <= 0 {
+		return true
+	}
+	var synced int64
+	if info, err := f.wt.Stat(f.path); err == nil {
+		synced = info.Size()
+	}
+	return f.manager.RepoSizeAllowed(size - synced)
 }
 
 // Unlink handles file deletion
@@ -58,6 +266,10 @@ func (f *GittyFile) Unlink(ctx context.Context, name string) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	if readOnly(f.manager) {
+		return syscall.EROFS
+	}
+
 	// Log the unlink operation
 	log.Printf("Unlink called on file: %s with name: %s", f.path, name)
 
@@ -72,7 +284,8 @@ func (f *GittyFile) Unlink(ctx context.Context, name string) syscall.Errno {
 
 	// If the file is dirty, we may want to clear its content
 	if f.dirty {
-		f.content = nil
+		f.content.Close()
+		f.content = newWriteBuffer(nil)
 		f.dirty = false
 	}
 
@@ -86,7 +299,44 @@ func (f *GittyFile) Unlink(ctx context.Context, name string) syscall.Errno {
 
 // Open handles file opening
 func (f *GittyFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
-	return f, 0, 0
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	writes := flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0
+	if writes && readOnly(f.manager) {
+		return nil, 0, syscall.EROFS
+	}
+
+	if errno := f.openSrcLocked(ctx); errno != 0 {
+		return nil, 0, errno
+	}
+	f.opens++
+
+	fh := &fileHandle{append: flags&syscall.O_APPEND != 0}
+
+	// The kernel may still hold the zero size a file of a partial clone
+	// had before its blob was fetched
+	if f.partial {
+		return fh, fuse.FOPEN_DIRECT_IO, 0
+	}
+	return fh, 0, 0
+}
+
+// Release closes the content source once the file is no longer open
+func (f *GittyFile) Release(ctx context.Context, fh fs.FileHandle) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.opens > 0 {
+		f.opens--
+	}
+	if f.opens == 0 {
+		f.closeSrcLocked()
+	}
+	if handle, ok := fh.(*fileHandle); ok {
+		f.releaseLocksLocked(handle)
+	}
+	return 0
 }
 
 // Write implements writing to the file
@@ -94,15 +344,33 @@ func (f *GittyFile) Write(ctx context.Context, fh fs.FileHandle, data []byte, of
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// Expand the content slice if needed
-	if int64(len(f.content)) < off+int64(len(data)) {
-		newSlice := make([]byte, off+int64(len(data)))
-		copy(newSlice, f.content)
-		f.content = newSlice
+	if readOnly(f.manager) {
+		return 0, syscall.EROFS
 	}
 
-	n := copy(f.content[off:], data)
-	f.dirty = true
+	if handle, ok := fh.(*fileHandle); ok && handle.append {
+		off = int64(f.sizeLocked())
+	}
+	if !f.manager.FileSizeAllowed(off + int64(len(data))) {
+		log.Printf("Write to %s exceeds the file size limit", f.path)
+		return 0, syscall.EFBIG
+	}
+	if !f.repoSizeAllowedLocked(max(off+int64(len(data)), int64(f.sizeLocked()))) {
+		log.Printf("Write to %s exceeds the repository size limit", f.path)
+		return 0, syscall.ENOSPC
+	}
+	if errno := f.loadLocked(ctx); errno != 0 {
+		return 0, errno
+	}
+
+	n, err := f.content.WriteAt(data, off)
+	if n > 0 {
+		f.dirty = true
+	}
+	if err != nil {
+		log.Printf("Error writing to %s: %v", f.path, err)
+		return uint32(n), syscall.EIO
+	}
 	return uint32(n), 0
 }
 
@@ -111,16 +379,36 @@ func (f *GittyFile) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	if off >= int64(len(f.content)) {
-		return fuse.ReadResultData([]byte{}), 0
+	if !f.loaded {
+		return f.readSrcLocked(ctx, dest, off)
+	}
+
+	n, err := f.content.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		log.Printf("Error reading %s: %v", f.path, err)
+		return nil, syscall.EIO
 	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
 
-	end := off + int64(len(dest))
-	if end > int64(len(f.content)) {
-		end = int64(len(f.content))
+// readSrcLocked serves a read of a file that is not loaded from its source
+func (f *GittyFile) readSrcLocked(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if errno := f.openSrcLocked(ctx); errno != 0 {
+		return nil, errno
+	}
+	if off >= f.size {
+		return fuse.ReadResultData([]byte{}), 0
+	}
+	if off+int64(len(dest)) > f.size {
+		dest = dest[:f.size-off]
 	}
 
-	return fuse.ReadResultData(f.content[off:end]), 0
+	n, err := f.src.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		log.Printf("Error reading content of %s: %v", f.path, err)
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
 }
 
 // Fsync persists the file to the underlying filesystem
@@ -132,22 +420,50 @@ func (f *GittyFile) Fsync(ctx context.Context, fh fs.FileHandle, flags uint32) s
 		return 0
 	}
 
-	// Write back to the billy filesystem
-	file, err := f.wt.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	// Write back to the billy filesystem, under every name of the file
+	paths := f.pathsLocked()
+	for _, p := range paths {
+		if errno := f.writeBackLocked(p); errno != 0 {
+			return errno
+		}
+	}
+
+	f.dirty = false
+	f.unloadLocked()
+	for _, p := range paths {
+		f.manager.NotifyChange(p, "write")
+	}
+	return 0
+}
+
+// writeBackLocked writes the content to p in the worktree
+func (f *GittyFile) writeBackLocked(p string) syscall.Errno {
+	file, err := f.wt.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		log.Printf("Error opening file for fsync: %v", err)
 		return syscall.EIO
 	}
 	defer file.Close()
 
-	_, err = file.Write(f.content)
+	// Files kept in Git LFS are written to the worktree as pointers
+	pointer, err := f.manager.CleanLFS(p, f.content.Reader())
 	if err != nil {
-		log.Printf("Error writing file during fsync: %v", err)
+		log.Printf("Error storing %s in LFS: %v", p, err)
 		return syscall.EIO
 	}
+	if p == f.path {
+		f.lfs = pointer
+	}
 
-	f.dirty = false
-	f.manager.NotifyChange(f.path, "write")
+	if pointer != nil {
+		_, err = file.Write(pointer.Encode())
+	} else {
+		_, err = io.Copy(file, f.content.Reader())
+	}
+	if err != nil {
+		log.Printf("Error writing file during fsync: %v", err)
+		return syscall.EIO
+	}
 	return 0
 }
 
@@ -172,18 +488,21 @@ func (f *GittyFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.Att
 		out.Ctime = uint64(mtime.Unix())
 		out.Ctimensec = uint32(mtime.Nanosecond())
 
-		// If we have in-memory content that's different (dirty), use its size
-		if f.dirty {
-			out.Size = uint64(len(f.content))
+		// If we have in-memory content that's different (dirty), use its size,
+		// the worktree only holds the pointer of LFS files
+		if f.dirty || f.lfs != nil {
+			out.Size = f.sizeLocked()
 		}
+		out.Nlink = uint32(1 + len(f.links))
 
 		return 0
 	}
 
 	// Fall back to in-memory state if file doesn't exist yet in filesystem
 	// (this could happen with newly created files before they're synced)
-	out.Size = uint64(len(f.content))
+	out.Size = f.sizeLocked()
 	out.Mode = 0700 // Default mode for files
+	out.Nlink = uint32(1 + len(f.links))
 
 	// Use current time as fallback
 	t := time.Now()
@@ -197,6 +516,10 @@ func (f *GittyFile) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetA
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	if readOnly(f.manager) {
+		return syscall.EROFS
+	}
+
 	log.Printf("Setattr on file: %s", f.path)
 
 	// Check what attributes are being set
@@ -205,19 +528,27 @@ func (f *GittyFile) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetA
 	// Handle size change (truncate)
 	if valid&fuse.FATTR_SIZE != 0 {
 		newSize := in.Size
+		if !f.manager.FileSizeAllowed(int64(newSize)) {
+			log.Printf("Truncate of %s exceeds the file size limit", f.path)
+			return syscall.EFBIG
+		}
+		if !f.repoSizeAllowedLocked(int64(newSize)) {
+			log.Printf("Truncate of %s exceeds the repository size limit", f.path)
+			return syscall.ENOSPC
+		}
+		if newSize == 0 && !f.loaded {
+			// Nothing to read when everything is thrown away
+			f.content = newWriteBuffer(nil)
+			f.loaded = true
+			f.closeSrcLocked()
+		} else if errno := f.loadLocked(ctx); errno != 0 {
+			return errno
+		}
 
-		// Resize the content slice
-		if newSize == 0 {
-			// Truncate to empty
-			f.content = []byte{}
-		} else if newSize < uint64(len(f.content)) {
-			// Truncate to smaller size
-			f.content = f.content[:newSize]
-		} else if newSize > uint64(len(f.content)) {
-			// Expand the file with zeros
-			newContent := make([]byte, newSize)
-			copy(newContent, f.content)
-			f.content = newContent
+		// Resize the content, growing it with zeros
+		if err := f.content.Truncate(int64(newSize)); err != nil {
+			log.Printf("Error truncating %s: %v", f.path, err)
+			return syscall.EIO
 		}
 
 		f.dirty = true
@@ -246,7 +577,7 @@ func (f *GittyFile) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetA
 	}
 
 	// Fill out the output attributes
-	out.Size = uint64(len(f.content))
+	out.Size = f.sizeLocked()
 	out.Mode = 0700 // Use the mode you want for files
 
 	// Set times
@@ -272,47 +603,84 @@ func (f *GittyFile) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetA
 	return 0
 }
 
-// Rename implements the NodeRenamer interface for GittyFile
-func (f *GittyFile) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
-	log.Printf("Rename: %s -> %s", f.path, newName)
+// fallocate modes, from linux/falloc.h
+const (
+	fallocKeepSize  = 0x1
+	fallocPunchHole = 0x2
+	fallocZeroRange = 0x10
+)
+
+// Allocate implements fallocate. Large content spills to a file in the cache
+// dir until synced but no space is reserved there, allocating only grows the
+// file with zeros. Punching holes and zeroing ranges write zeros over the
+// range.
+func (f *GittyFile) Allocate(ctx context.Context, fh fs.FileHandle, off uint64, size uint64, mode uint32) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-	// Get the new parent directory
-	newParentDir, ok := newParent.(*GittyDir)
-	if !ok {
-		log.Printf("Error: New parent is not a GittyDir")
-		return syscall.EINVAL
+	if readOnly(f.manager) {
+		return syscall.EROFS
 	}
 
-	// Get the old path and construct the new path
-	oldPath := f.path
-	newPath := filepath.Join(newParentDir.path, newName)
-
-	// Check if the destination already exists
-	_, err := f.wt.Stat(newPath)
-	if err == nil {
-		// Destination exists, remove it first (POSIX Rename behavior)
-		err = f.wt.Remove(newPath)
-		if err != nil {
-			log.Printf("Error removing existing destination %s: %v", newPath, err)
-			return syscall.EIO
+	keepSize := mode&fallocKeepSize != 0
+	switch mode &^ fallocKeepSize {
+	case 0, fallocZeroRange:
+	case fallocPunchHole:
+		if !keepSize {
+			return syscall.EINVAL
 		}
+	default:
+		return syscall.EOPNOTSUPP
 	}
 
-	// Perform the rename operation in the underlying filesystem
-	err = f.wt.Rename(oldPath, newPath)
-	if err != nil {
-		log.Printf("Error renaming %s to %s: %v", oldPath, newPath, err)
-		return syscall.EIO
+	end := off + size
+	grow := !keepSize && end > f.sizeLocked()
+	if mode == 0 && !grow || mode == fallocKeepSize {
+		return 0
 	}
 
-	// Update the path in the GittyFile struct
-	f.path = newPath
+	if grow {
+		if !f.manager.FileSizeAllowed(int64(end)) {
+			log.Printf("Allocate on %s exceeds the file size limit", f.path)
+			return syscall.EFBIG
+		}
+		if !f.repoSizeAllowedLocked(int64(end)) {
+			log.Printf("Allocate on %s exceeds the repository size limit", f.path)
+			return syscall.ENOSPC
+		}
+	}
+	if errno := f.loadLocked(ctx); errno != 0 {
+		return errno
+	}
 
-	// Notify the manager about the rename
-	if f.manager != nil {
-		f.manager.NotifyChange(oldPath, "rename")
-		f.manager.NotifyChange(newPath, "create")
+	// Zero what is already there, then grow with zeros
+	if mode&(fallocPunchHole|fallocZeroRange) != 0 {
+		zeros := make([]byte, min(size, copyChunk))
+		for at := off; at < min(end, f.sizeLocked()); at += uint64(len(zeros)) {
+			n := min(uint64(len(zeros)), min(end, f.sizeLocked())-at)
+			if _, err := f.content.WriteAt(zeros[:n], int64(at)); err != nil {
+				log.Printf("Error zeroing %s: %v", f.path, err)
+				return syscall.EIO
+			}
+		}
+	}
+	if grow {
+		if err := f.content.Truncate(int64(end)); err != nil {
+			log.Printf("Error allocating %s: %v", f.path, err)
+			return syscall.EIO
+		}
 	}
 
+	f.dirty = true
 	return 0
 }
+
+// OnForget releases the inode number of a file that was removed
+func (f *GittyFile) OnForget() {
+	releaseNode(&f.Inode)
+}
+
+// Statfs reports the capacity of the mount
+func (f *GittyFile) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return statfs(f.manager, out)
+}
@@ -0,0 +1,129 @@
+package gittyfuse
+
+import (
+	"context"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/tryy3/gittyfs/manager"
+)
+
+// GittySubmodule is the directory of a submodule. The submodule is cloned on
+// first access and its tree added below the directory, served by a GittyDir
+// tree of its own with its own manager.
+type GittySubmodule struct {
+	GittyDir
+	mu     sync.Mutex
+	parent *manager.Manager
+	loaded bool
+}
+
+var _ = (fs.NodeLookuper)((*GittySubmodule)(nil))
+var _ = (fs.NodeReaddirer)((*GittySubmodule)(nil))
+var _ = (fs.NodeGetattrer)((*GittySubmodule)(nil))
+var _ = (fs.NodeSetattrer)((*GittySubmodule)(nil))
+
+// NewGittySubmodule creates the directory of the submodule at path
+func NewGittySubmodule(path string, parent *manager.Manager) *GittySubmodule {
+	return &GittySubmodule{
+		GittyDir: GittyDir{path: path},
+		parent:   parent,
+	}
+}
+
+// load clones the submodule and adds its tree, the GittyDir is pointed at the
+// submodule worktree so that changes below it go to the submodule manager
+func (s *GittySubmodule) load(ctx context.Context) syscall.Errno {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.loaded {
+		return 0
+	}
+
+	sub, repo, err := s.parent.OpenSubmodule(s.path)
+	if err != nil {
+		log.Printf("Error opening submodule %s: %v", s.path, err)
+		return syscall.EIO
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		log.Printf("Error opening submodule %s: %v", s.path, err)
+		return syscall.EIO
+	}
+
+	s.GittyDir.path = ""
+	s.GittyDir.wt = wt.Filesystem
+	s.GittyDir.manager = sub
+	traverseTree(ctx, &s.Inode, wt.Filesystem, "", sub, sub.SubmodulePaths(), nil)
+
+	s.loaded = true
+	return 0
+}
+
+func (s *GittySubmodule) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if errno := s.load(ctx); errno != 0 {
+		return nil, errno
+	}
+
+	child := s.GetChild(name)
+	if child == nil {
+		return nil, syscall.ENOENT
+	}
+	if getattrer, ok := child.Operations().(fs.NodeGetattrer); ok {
+		var attr fuse.AttrOut
+		getattrer.Getattr(ctx, nil, &attr)
+		out.Attr = attr.Attr
+	}
+	return child, 0
+}
+
+func (s *GittySubmodule) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	if errno := s.load(ctx); errno != 0 {
+		return nil, errno
+	}
+
+	entries := []fuse.DirEntry{}
+	for name, child := range s.Children() {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: child.Mode(), Ino: child.StableAttr().Ino})
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+// Getattr does not clone the submodule, listing the parent directory should
+// stay cheap
+func (s *GittySubmodule) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	s.mu.Lock()
+	loaded := s.loaded
+	s.mu.Unlock()
+
+	if loaded {
+		return s.GittyDir.Getattr(ctx, fh, out)
+	}
+
+	out.Mode = 0755 | syscall.S_IFDIR
+	out.Nlink = 2
+	t := time.Now()
+	out.SetTimes(&t, &t, &t)
+	return 0
+}
+
+// Setattr does not clone the submodule either, attribute changes of
+// directories are not kept so there is nothing to apply before it is loaded
+func (s *GittySubmodule) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	s.mu.Lock()
+	loaded := s.loaded
+	s.mu.Unlock()
+
+	if loaded {
+		return s.GittyDir.Setattr(ctx, fh, in, out)
+	}
+	if readOnly(s.parent) {
+		return syscall.EROFS
+	}
+	return s.Getattr(ctx, fh, out)
+}
@@ -0,0 +1,93 @@
+package gittyfuse
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"path"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/tryy3/gittyfs/manager"
+)
+
+// inodeTable hands out inode numbers derived from the path of a node in the
+// mount, so that a file keeps its number across mounts. A number is not
+// handed out twice while its node is alive, a path that is used again after a
+// rename or a delete gets the next free one.
+type inodeTable struct {
+	mu    sync.Mutex
+	used  map[uint64]bool
+	blobs map[*manager.Manager]blobHashes
+}
+
+// blobHashes are the blobs in the index of a manager when HEAD was at head
+type blobHashes struct {
+	head   plumbing.Hash
+	hashes map[string]plumbing.Hash
+}
+
+func newInodeTable() *inodeTable {
+	return &inodeTable{
+		used:  map[uint64]bool{},
+		blobs: map[*manager.Manager]blobHashes{},
+	}
+}
+
+// attr returns the attributes of a new node at p in the mount. The
+// generation of a file comes from the blob it has in the index of m as of
+// the last commit, so it changes along with the content.
+func (t *inodeTable) attr(p string, mode uint32, m *manager.Manager, repoPath string) fs.StableAttr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h := fnv.New64a()
+	h.Write([]byte(p))
+	// The root is 1 and go-fuse numbers nodes it is not told about from
+	// 1<<63 up
+	ino := h.Sum64() &^ (1 << 63)
+	for ino < 2 || t.used[ino] {
+		ino = (ino + 1) &^ (1 << 63)
+	}
+	t.used[ino] = true
+
+	attr := fs.StableAttr{Mode: mode, Ino: ino, Gen: 1}
+	if m == nil {
+		return attr
+	}
+	blobs, ok := t.blobs[m]
+	if head := m.Head(); !ok || blobs.head != head {
+		blobs = blobHashes{head: head, hashes: m.BlobHashes()}
+		t.blobs[m] = blobs
+	}
+	if blob, ok := blobs.hashes[repoPath]; ok {
+		if gen := binary.BigEndian.Uint64(blob[:8]); gen != 0 {
+			attr.Gen = gen
+		}
+	}
+	return attr
+}
+
+// release makes the number of a node that is gone free for new ones
+func (t *inodeTable) release(ino uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.used, ino)
+}
+
+// releaseNode releases the number of node, it is called from OnForget
+func releaseNode(node *fs.Inode) {
+	if root, ok := node.Root().Operations().(*Filesystem); ok {
+		root.inodes.release(node.StableAttr().Ino)
+	}
+}
+
+// stableAttr returns the attributes of a node called name that is added
+// below parent, repoPath is its path in the worktree of m
+func stableAttr(parent *fs.Inode, name string, mode uint32, m *manager.Manager, repoPath string) fs.StableAttr {
+	root, ok := parent.Root().Operations().(*Filesystem)
+	if !ok {
+		return fs.StableAttr{Mode: mode}
+	}
+	return root.inodes.attr(path.Join(parent.Path(nil), name), mode, m, repoPath)
+}
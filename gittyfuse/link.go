@@ -0,0 +1,115 @@
+package gittyfuse
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Link adds name as another name of the file target. Git has no hard links,
+// every name is committed as a file of its own with the same content.
+func (d *GittyDir) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	path := filepath.Join(d.path, name)
+	log.Printf("Link: %s", path)
+	if readOnly(d.manager) {
+		return nil, syscall.EROFS
+	}
+
+	file, ok := target.(*GittyFile)
+	if !ok {
+		return nil, syscall.EPERM
+	}
+	if file.manager != d.manager {
+		// Linking in or out of a submodule crosses repositories
+		return nil, syscall.EXDEV
+	}
+	if d.hidden(path) {
+		log.Printf("Not linking %s, it is left out of the mount", path)
+		return nil, syscall.EEXIST
+	}
+
+	if err := file.link(path); err != nil {
+		log.Printf("Error linking %s: %v", path, err)
+		return nil, syscall.EIO
+	}
+
+	var attr fuse.AttrOut
+	file.Getattr(ctx, nil, &attr)
+	out.Attr = attr.Attr
+
+	if d.manager != nil {
+		d.manager.NotifyChange(path, "create")
+	}
+	return file.EmbeddedInode(), 0
+}
+
+// link adds p as a name of the file, it gets what the worktree holds for the
+// file and unsynced changes follow on the next fsync
+func (f *GittyFile) link(p string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := f.wt.Stat(f.path)
+	switch {
+	case err == nil:
+		err = copyFile(f.wt, f.path, p, info.Mode().Perm())
+	case os.IsNotExist(err):
+		// Never synced, there is nothing to copy yet
+		err = util.WriteFile(f.wt, p, nil, 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	f.links = append(f.links, p)
+	return nil
+}
+
+// pathsLocked returns every name of the file
+func (f *GittyFile) pathsLocked() []string {
+	return append([]string{f.path}, f.links...)
+}
+
+// movePath renames the name oldPath of the file to newPath
+func (f *GittyFile) movePath(oldPath, newPath string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, p := range f.links {
+		if p == oldPath {
+			f.links[i] = newPath
+			return
+		}
+	}
+	f.path = newPath
+}
+
+// dropPath forgets the name p of the file once it was removed, a file that
+// is hard linked keeps its other names. It reports whether the file still
+// has a name.
+func (f *GittyFile) dropPath(p string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, link := range f.links {
+		if link == p {
+			f.links = append(f.links[:i], f.links[i+1:]...)
+			return true
+		}
+	}
+	if f.path != p {
+		return true
+	}
+	if len(f.links) == 0 {
+		return false
+	}
+	f.path = f.links[0]
+	f.links = f.links[1:]
+	return true
+}
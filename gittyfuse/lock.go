@@ -0,0 +1,173 @@
+package gittyfuse
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// fileLock is an advisory lock on a range of a file. Locks are only seen by
+// processes using the mount and go when the handle they were taken through
+// is released.
+type fileLock struct {
+	fh    *fileHandle
+	owner uint64
+	flock bool
+	lk    fuse.FileLock
+}
+
+func (l *fileLock) overlaps(lk *fuse.FileLock) bool {
+	return l.lk.Start <= lk.End && lk.Start <= l.lk.End
+}
+
+// conflictLocked returns the lock that keeps owner from taking lk
+func (f *GittyFile) conflictLocked(owner uint64, lk *fuse.FileLock, flock bool) *fileLock {
+	for i := range f.locks {
+		l := &f.locks[i]
+		if l.owner == owner || l.flock != flock || !l.overlaps(lk) {
+			continue
+		}
+		if l.lk.Typ == syscall.F_WRLCK || lk.Typ == syscall.F_WRLCK {
+			return l
+		}
+	}
+	return nil
+}
+
+// cutLocks returns locks without what owner holds on the range of lk, ranges
+// that only partly overlap are cut down
+func cutLocks(locks []fileLock, owner uint64, lk *fuse.FileLock, flock bool) []fileLock {
+	var kept []fileLock
+	for _, l := range locks {
+		if l.owner != owner || l.flock != flock || !l.overlaps(lk) {
+			kept = append(kept, l)
+			continue
+		}
+		if l.lk.Start < lk.Start {
+			left := l
+			left.lk.End = lk.Start - 1
+			kept = append(kept, left)
+		}
+		if l.lk.End > lk.End {
+			right := l
+			right.lk.Start = lk.End + 1
+			kept = append(kept, right)
+		}
+	}
+	return kept
+}
+
+// setLocksLocked replaces the locks of the file, waking up whoever waits for
+// one and telling the manager when the file stops or starts being write
+// locked
+func (f *GittyFile) setLocksLocked(locks []fileLock) {
+	wasLocked := f.writeLockedLocked()
+	f.locks = locks
+	if isLocked := f.writeLockedLocked(); isLocked != wasLocked {
+		// The file may be renamed while locked
+		if isLocked {
+			f.lockedPath = f.path
+			f.manager.LockFile(f.lockedPath)
+		} else {
+			f.manager.UnlockFile(f.lockedPath)
+		}
+	}
+
+	if f.lockWait != nil {
+		close(f.lockWait)
+		f.lockWait = nil
+	}
+}
+
+func (f *GittyFile) writeLockedLocked() bool {
+	for _, l := range f.locks {
+		if l.lk.Typ == syscall.F_WRLCK {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseLocksLocked drops the locks taken through fh
+func (f *GittyFile) releaseLocksLocked(fh *fileHandle) {
+	var kept []fileLock
+	for _, l := range f.locks {
+		if l.fh != fh {
+			kept = append(kept, l)
+		}
+	}
+	if len(kept) != len(f.locks) {
+		f.setLocksLocked(kept)
+	}
+}
+
+func (f *GittyFile) setlkLocked(fh fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	flock := flags&fuse.FUSE_LK_FLOCK != 0
+
+	switch lk.Typ {
+	case syscall.F_UNLCK:
+		f.setLocksLocked(cutLocks(f.locks, owner, lk, flock))
+		return 0
+	case syscall.F_RDLCK, syscall.F_WRLCK:
+	default:
+		return syscall.EINVAL
+	}
+
+	if f.conflictLocked(owner, lk, flock) != nil {
+		return syscall.EAGAIN
+	}
+
+	// A new lock replaces whatever owner held on the range
+	handle, _ := fh.(*fileHandle)
+	locks := cutLocks(f.locks, owner, lk, flock)
+	f.setLocksLocked(append(locks, fileLock{fh: handle, owner: owner, flock: flock, lk: *lk}))
+	return 0
+}
+
+// Getlk returns the lock that keeps owner from taking lk, if there is one
+func (f *GittyFile) Getlk(ctx context.Context, fh fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if l := f.conflictLocked(owner, lk, flags&fuse.FUSE_LK_FLOCK != 0); l != nil {
+		*out = l.lk
+		return 0
+	}
+	*out = *lk
+	out.Typ = syscall.F_UNLCK
+	return 0
+}
+
+// Setlk takes or releases a lock, failing with EAGAIN when it is held by
+// someone else
+func (f *GittyFile) Setlk(ctx context.Context, fh fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.setlkLocked(fh, owner, lk, flags)
+}
+
+// Setlkw takes or releases a lock, waiting for it to be released when it is
+// held by someone else
+func (f *GittyFile) Setlkw(ctx context.Context, fh fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	for {
+		f.mu.Lock()
+		errno := f.setlkLocked(fh, owner, lk, flags)
+		if errno != syscall.EAGAIN {
+			f.mu.Unlock()
+			return errno
+		}
+		if f.lockWait == nil {
+			f.lockWait = make(chan struct{})
+		}
+		wait := f.lockWait
+		f.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package gittyfuse
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+// sparseFilter decides which paths are in a sparse mount
+type sparseFilter struct {
+	matcher gitignore.Matcher
+
+	// anywhere is set when a pattern without a slash, such as "*.md", may
+	// match at any depth. Otherwise anchored holds the path elements of
+	// every pattern that adds paths.
+	anywhere bool
+	anchored [][]string
+}
+
+// newSparseFilter parses gitignore style patterns, nil means that every path
+// is in the mount
+func newSparseFilter(patterns []string) *sparseFilter {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	s := &sparseFilter{}
+	var parsed []gitignore.Pattern
+	for _, p := range patterns {
+		parsed = append(parsed, gitignore.ParsePattern(p, nil))
+
+		// Negated patterns only take paths out again
+		if strings.HasPrefix(p, "!") {
+			continue
+		}
+		p = strings.TrimSuffix(strings.TrimRight(p, " "), "/")
+		if !strings.Contains(p, "/") {
+			s.anywhere = true
+			continue
+		}
+		s.anchored = append(s.anchored, strings.Split(strings.TrimPrefix(p, "/"), "/"))
+	}
+	s.matcher = gitignore.NewMatcher(parsed)
+	return s
+}
+
+// Match reports whether path is in the mount
+func (s *sparseFilter) Match(path []string, isDir bool) bool {
+	return s == nil || s.matcher.Match(path, isDir)
+}
+
+// MayHold reports whether something below the directory dir can be in the
+// mount, directories that can not are never read
+func (s *sparseFilter) MayHold(dir []string) bool {
+	if s == nil || s.anywhere {
+		return true
+	}
+	for _, pattern := range s.anchored {
+		if mayHold(pattern, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayHold reports whether the path elements of an anchored pattern can match
+// dir or something below it
+func mayHold(pattern, dir []string) bool {
+	for i, elem := range pattern {
+		if elem == "**" || i == len(dir) {
+			return true
+		}
+		if ok, err := filepath.Match(elem, dir[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return true // dir is inside of what the pattern matches
+}
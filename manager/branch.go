@@ -0,0 +1,61 @@
+package manager
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// SessionBranch is a push branch template giving every mount session its own
+// branch, see ExpandBranch for the placeholders
+const SessionBranch = "gittyfs/{hostname}/{date}-{time}"
+
+// ExpandBranch fills in the placeholders of a push branch template:
+// {hostname}, {date} (2006-01-02), {time} (150405) and {branch}, the name of
+// the mounted branch
+func ExpandBranch(template string, branch string, now time.Time) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return strings.NewReplacer(
+		"{hostname}", hostname,
+		"{date}", now.Format("2006-01-02"),
+		"{time}", now.Format("150405"),
+		"{branch}", branch,
+	).Replace(template)
+}
+
+// switchBranch moves HEAD to a new local branch starting at the current
+// commit, the worktree is left alone as the content does not change. Commits
+// then land on the new branch and pushes create it on the remote while the
+// mounted branch stays untouched.
+func (m *Manager) switchBranch(template string) error {
+	head, err := m.repository.Head()
+	if err != nil {
+		return fmt.Errorf("failed to get head: %w", err)
+	}
+
+	name := ExpandBranch(template, head.Name().Short(), time.Now())
+	ref := plumbing.NewBranchReferenceName(name)
+	if err := ref.Validate(); err != nil {
+		return fmt.Errorf("invalid push branch %s: %w", name, err)
+	}
+
+	err = m.repository.Storer.SetReference(plumbing.NewHashReference(ref, head.Hash()))
+	if err != nil {
+		return fmt.Errorf("failed to create branch %s: %w", name, err)
+	}
+	err = m.repository.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, ref))
+	if err != nil {
+		return fmt.Errorf("failed to switch to branch %s: %w", name, err)
+	}
+
+	log.Printf("Committing to branch %s instead of %s", name, head.Name().Short())
+	return nil
+}
@@ -0,0 +1,155 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// diskStorage is the object storage of a clone kept on disk, objects being
+// written that are larger than spoolSize are kept in spoolDir
+type diskStorage struct {
+	*filesystem.Storage
+	spoolDir  string
+	spoolSize int64
+}
+
+func (s *diskStorage) NewEncodedObject() plumbing.EncodedObject {
+	return newSpoolObject(s.spoolDir, s.spoolSize)
+}
+
+func (s *diskStorage) BlobSize(h plumbing.Hash) (int64, bool) {
+	size, err := s.EncodedObjectSize(h)
+	return size, err == nil
+}
+
+// defaultLargeObject is the size past which objects are kept on disk when the
+// repository does not say
+const defaultLargeObject = 1 << 20
+
+// largeObject returns the size past which objects of the repository are kept
+// on disk
+func (m *Manager) largeObject() int64 {
+	if s, ok := m.repository.Storer.(*diskStorage); ok {
+		return s.spoolSize
+	}
+	return defaultLargeObject
+}
+
+// Clone clones branch of url, or the remote HEAD when branch is empty, into
+// dir without checking it out. Objects are kept on disk and objects larger
+// than largeObject are never read into memory whole, not even when a file is
+// staged. The worktree of the returned repository is a TreeFS of the cloned
+// commit, files larger than largeObject are read from copies in dir and
+// written files are kept there too. dir is left behind for the caller to
+// remove.
+func Clone(url, branch string, auth transport.AuthMethod, dir string, largeObject int64) (*git.Repository, error) {
+	return cloneCommit(url, branch, plumbing.ZeroHash, auth, dir, largeObject)
+}
+
+// cloneCommit is Clone with the branch put on commit instead of the tip of
+// the remote branch, a zero commit is the tip. Only the tip is cloned without
+// its history.
+func cloneCommit(url, branch string, commitHash plumbing.Hash, auth transport.AuthMethod, dir string, largeObject int64) (*git.Repository, error) {
+	gitDir := filepath.Join(dir, "git")
+	worktreeDir := filepath.Join(dir, "worktree")
+	blobDir := filepath.Join(dir, "blobs")
+	for _, d := range []string{gitDir, worktreeDir, blobDir} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	var ref plumbing.ReferenceName
+	if branch != "" {
+		ref = plumbing.NewBranchReferenceName(branch)
+	}
+	options := &git.CloneOptions{
+		Auth:          auth,
+		URL:           url,
+		ReferenceName: ref,
+		Tags:          git.NoTags,
+		Depth:         1,
+		SingleBranch:  true,
+	}
+
+	s, r, err := cloneStorage(gitDir, largeObject, options)
+	if err != nil {
+		return nil, err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	if commitHash.IsZero() {
+		commitHash = head.Hash()
+	} else if commitHash != head.Hash() {
+		// The commit is behind the tip, it takes the history to reach it
+		if err := os.RemoveAll(gitDir); err != nil {
+			return nil, err
+		}
+		options.Depth = 0
+		if s, r, err = cloneStorage(gitDir, largeObject, options); err != nil {
+			return nil, err
+		}
+		if err := r.Storer.SetReference(plumbing.NewHashReference(head.Name(), commitHash)); err != nil {
+			return nil, err
+		}
+	}
+
+	commit, err := object.GetCommit(s, commitHash)
+	if err != nil {
+		return nil, fmt.Errorf("commit %s: %w", commitHash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.SetIndex(treeIndex(tree)); err != nil {
+		return nil, err
+	}
+
+	// The clone was made without a worktree, it has one from now on
+	conf, err := s.Config()
+	if err != nil {
+		return nil, err
+	}
+	conf.Core.IsBare = false
+	if err := s.SetConfig(conf); err != nil {
+		return nil, fmt.Errorf("set config: %w", err)
+	}
+
+	storage := &diskStorage{Storage: s, spoolDir: blobDir, spoolSize: largeObject}
+	wt, err := NewTreeFS(storage, tree, commit.Committer.When, osfs.New(worktreeDir, osfs.WithBoundOS()))
+	if err != nil {
+		return nil, err
+	}
+	wt.spoolDir = blobDir
+	wt.spoolSize = largeObject
+	return git.Open(storage, wt)
+}
+
+// cloneStorage clones into an object storage kept in gitDir
+func cloneStorage(gitDir string, largeObject int64, options *git.CloneOptions) (*filesystem.Storage, *git.Repository, error) {
+	if err := os.MkdirAll(gitDir, 0700); err != nil {
+		return nil, nil, err
+	}
+	s := filesystem.NewStorageWithOptions(osfs.New(gitDir), cache.NewObjectLRUDefault(), filesystem.Options{
+		ExclusiveAccess:      true,
+		LargeObjectThreshold: largeObject,
+	})
+	r, err := git.Clone(s, nil, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, r, nil
+}
@@ -0,0 +1,207 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+)
+
+// RepoPreCommitHook is run when no hooks are configured, the repository
+// contains it and Options.RepoHooks allows it. Anyone who can push to the
+// remote controls it, so it is never run by default.
+const RepoPreCommitHook = ".githooks/pre-commit"
+
+// hookTimeout bounds how long a single hook may run
+const hookTimeout = 5 * time.Minute
+
+// maxHookOutput is how much of a failing hook's output ends up in the error
+const maxHookOutput = 4096
+
+// HookError is returned when a pre-commit hook rejects a commit
+type HookError struct {
+	Hook   string
+	Output string
+	Err    error
+}
+
+func (e *HookError) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("pre-commit hook %q failed: %v", e.Hook, e.Err)
+	}
+	return fmt.Sprintf("pre-commit hook %q failed: %v\n%s", e.Hook, e.Err, e.Output)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// hookFile is a file of the hook checkout as it was written, files whose
+// entry and stat did not change are not written again
+type hookFile struct {
+	hash    plumbing.Hash
+	mode    filemode.FileMode
+	size    int64
+	modTime time.Time
+}
+
+// runHooksLocked runs the pre-commit hooks against a checkout of the staged
+// tree, the first failing hook rejects the commit
+func (m *Manager) runHooksLocked() error {
+	idx, err := m.repository.Storer.Index()
+	if err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+
+	hooks := m.hooks
+	if len(hooks) == 0 && m.options.RepoHooks {
+		if entry, err := idx.Entry(RepoPreCommitHook); err == nil {
+			if entry.Mode == filemode.Executable {
+				hooks = []string{"./" + RepoPreCommitHook}
+			} else {
+				hooks = []string{"sh " + RepoPreCommitHook}
+			}
+		}
+	}
+	if len(hooks) == 0 {
+		return nil // No hooks to run
+	}
+
+	dir, err := m.hookCheckoutLocked(idx)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		log.Printf("Running pre-commit hook: %s", hook)
+
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		cmd := exec.CommandContext(ctx, "sh", "-c", hook)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		cancel()
+
+		if err != nil {
+			if len(out) > maxHookOutput {
+				out = out[len(out)-maxHookOutput:]
+			}
+			return &HookError{Hook: hook, Output: string(out), Err: err}
+		}
+	}
+
+	return nil
+}
+
+// hookCheckoutLocked brings the hook checkout in line with the index and
+// returns its directory. The checkout is kept from one commit to the next so
+// that only what changed is written. In a partial clone files whose blobs are
+// not at hand are left out rather than fetched.
+func (m *Manager) hookCheckoutLocked(idx *index.Index) (string, error) {
+	if m.hookDir == "" {
+		dir, err := os.MkdirTemp("", "gittyfs-hook-")
+		if err != nil {
+			return "", fmt.Errorf("failed to create hook checkout: %w", err)
+		}
+		m.hookDir = dir
+		m.hookFiles = map[string]hookFile{}
+	}
+
+	wanted := map[string]*index.Entry{}
+	for _, entry := range idx.Entries {
+		if entry.Mode == filemode.Submodule {
+			continue
+		}
+		if m.partial != nil && !m.partial.HasBlob(entry.Hash) {
+			continue
+		}
+		wanted[entry.Name] = entry
+	}
+
+	// Stale files go first, a directory may have become a file or the
+	// other way around
+	for name := range m.hookFiles {
+		if _, ok := wanted[name]; !ok {
+			os.RemoveAll(filepath.Join(m.hookDir, filepath.FromSlash(name)))
+			delete(m.hookFiles, name)
+		}
+	}
+
+	for name, entry := range wanted {
+		path := filepath.Join(m.hookDir, filepath.FromSlash(name))
+		if file, ok := m.hookFiles[name]; ok && file.hash == entry.Hash && file.mode == entry.Mode {
+			// Hooks may have changed the file since
+			if info, err := os.Lstat(path); err == nil && info.Size() == file.size && info.ModTime().Equal(file.modTime) {
+				continue
+			}
+		}
+
+		delete(m.hookFiles, name)
+		if err := m.checkoutEntry(m.hookDir, name, entry.Hash, entry.Mode); err != nil {
+			return "", fmt.Errorf("failed to check out %s for hooks: %w", name, err)
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to check out %s for hooks: %w", name, err)
+		}
+		m.hookFiles[name] = hookFile{hash: entry.Hash, mode: entry.Mode, size: info.Size(), modTime: info.ModTime()}
+	}
+
+	return m.hookDir, nil
+}
+
+// checkoutEntry writes a single index entry below dir, replacing whatever is
+// at its path
+func (m *Manager) checkoutEntry(dir, name string, hash plumbing.Hash, mode filemode.FileMode) error {
+	if mode == filemode.Submodule {
+		return nil
+	}
+
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Never write through a symlink left by an earlier checkout
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+
+	blob, err := m.repository.BlobObject(hash)
+	if err != nil {
+		return err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if mode == filemode.Symlink {
+		target, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(string(target), path)
+	}
+
+	perm := os.FileMode(0644)
+	if mode == filemode.Executable {
+		perm = 0755
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
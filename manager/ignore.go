@@ -0,0 +1,188 @@
+package manager
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+)
+
+// DefaultIgnorePatterns covers the swap, backup and lock files editors leave
+// next to the files being edited
+var DefaultIgnorePatterns = []string{"*.swp", "*.swo", "*.swx", "*~", ".#*", "4913"}
+
+// loadIgnoreLocked rebuilds the ignore matcher from .gitignore files,
+// .git/info/exclude and the configured patterns
+func (m *Manager) loadIgnoreLocked() {
+	var patterns []gitignore.Pattern
+
+	wt, err := m.repository.Worktree()
+	if err == nil {
+		// ReadPatterns also picks up .git/info/exclude
+		patterns, err = gitignore.ReadPatterns(wt.Filesystem, nil)
+	}
+	if err != nil {
+		log.Printf("Error reading ignore files: %v", err)
+	}
+
+	for _, p := range m.ignore {
+		patterns = append(patterns, gitignore.ParsePattern(p, nil))
+	}
+
+	m.ignoreMatcher = gitignore.NewMatcher(patterns)
+}
+
+// isIgnoredLocked reports whether changes to p should stay out of commits,
+// files that are already tracked are never ignored
+func (m *Manager) isIgnoredLocked(p string) bool {
+	if m.ignoreMatcher == nil {
+		m.loadIgnoreLocked()
+	}
+	if !m.ignoreMatcher.Match(strings.Split(p, "/"), false) {
+		return false
+	}
+
+	idx, err := m.repository.Storer.Index()
+	if err != nil {
+		return true
+	}
+	_, err = idx.Entry(p)
+	return err != nil
+}
+
+// stageLocked adds every changed path to the index except for ignored and
+// write locked ones, it returns how many paths differ from HEAD once staged
+func (m *Manager) stageLocked(wt *git.Worktree) (int, error) {
+	if _, ok := wt.Filesystem.(*TreeFS); ok {
+		return m.stagePendingLocked(wt)
+	}
+	m.loadIgnoreLocked()
+
+	status, err := wt.Status()
+	if err != nil {
+		return 0, err
+	}
+
+	// The index is written once, adding path by path would write it and
+	// walk the worktree for every removed file
+	idx, err := m.repository.Storer.Index()
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	staged := false
+	for p, s := range status {
+		if s.Worktree == git.Unmodified {
+			if s.Staging != git.Unmodified {
+				changed++ // Staged by an earlier attempt
+			}
+			continue
+		}
+		if s.Staging == git.Untracked && m.isIgnoredLocked(p) {
+			log.Printf("Not committing ignored file %s", p)
+			continue
+		}
+		if m.skipLockedLocked(p) {
+			continue
+		}
+
+		if err := m.addToIndexLocked(wt.Filesystem, idx, p); err != nil {
+			return 0, err
+		}
+		staged = true
+		changed++
+	}
+
+	if staged {
+		if err := m.repository.Storer.SetIndex(idx); err != nil {
+			return 0, err
+		}
+	}
+	return changed, nil
+}
+
+// addToIndexLocked stores the file at p as a blob and points its entry in idx
+// at it like git add does, a path that is gone is taken out of idx
+func (m *Manager) addToIndexLocked(fs billy.Filesystem, idx *index.Index, p string) (err error) {
+	info, err := fs.Lstat(p)
+	if os.IsNotExist(err) {
+		removeFromIndex(idx, p)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	obj := m.repository.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	obj.SetSize(info.Size())
+	w, err := obj.Writer()
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		var target string
+		if target, err = fs.Readlink(p); err == nil {
+			_, err = w.Write([]byte(target))
+		}
+	} else {
+		var file billy.File
+		if file, err = fs.Open(p); err == nil {
+			_, err = io.Copy(w, file)
+			file.Close()
+		}
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("add %s: %w", p, err)
+	}
+
+	hash, err := m.repository.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return fmt.Errorf("add %s: %w", p, err)
+	}
+
+	entry, err := idx.Entry(p)
+	if err == index.ErrEntryNotFound {
+		entry, err = idx.Add(p), nil
+	}
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	entry.ModifiedAt = info.ModTime()
+	entry.Size = uint32(info.Size())
+	entry.Mode, err = filemode.NewFromOSFileMode(info.Mode())
+	return err
+}
+
+// removeFromIndex takes p and everything below it out of idx, it reports
+// whether anything was removed
+func removeFromIndex(idx *index.Index, p string) bool {
+	entries := idx.Entries[:0]
+	for _, entry := range idx.Entries {
+		if entry.Name != p && !isBelow(entry.Name, p) {
+			entries = append(entries, entry)
+		}
+	}
+	removed := len(entries) != len(idx.Entries)
+	idx.Entries = entries
+	return removed
+}
+
+// isIgnoreFile reports whether p changes what is ignored
+func isIgnoreFile(p string) bool {
+	return path.Base(p) == ".gitignore"
+}
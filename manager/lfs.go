@@ -0,0 +1,587 @@
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/format/gitattributes"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	lfsPointerVersion = "https://git-lfs.github.com/spec/v1"
+	lfsMediaType      = "application/vnd.git-lfs+json"
+
+	// lfsConfigFile may set lfs.url in the repository itself
+	lfsConfigFile = ".lfsconfig"
+
+	// lfsBatchTimeout bounds a batch API request, transfers get
+	// lfsTransferTimeout plus the time their size takes at lfsMinRate
+	lfsBatchTimeout    = time.Minute
+	lfsTransferTimeout = time.Minute
+	lfsMinRate         = 64 << 10
+)
+
+// LFSMaxPointerSize is the size git-lfs gives up looking for a pointer, larger
+// files are never LFS pointers
+const LFSMaxPointerSize = 1024
+
+// lfsClient talks to LFS servers. Uploads run while the manager is locked, so
+// a server that stops answering has to fail the push rather than hang it.
+var lfsClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// lfsTransferContext bounds the transfer of an object of size bytes
+func lfsTransferContext(ctx context.Context, size int64) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, lfsTransferTimeout+time.Duration(size/lfsMinRate)*time.Second)
+}
+
+// LFSPointer is the stand-in git stores for a file kept in Git LFS
+type LFSPointer struct {
+	OID  string
+	Size int64
+}
+
+// ParseLFSPointer parses the content of a pointer file
+func ParseLFSPointer(data []byte) (LFSPointer, bool) {
+	var p LFSPointer
+	if len(data) > LFSMaxPointerSize || !bytes.HasPrefix(data, []byte("version "+lfsPointerVersion+"\n")) {
+		return p, false
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		switch key {
+		case "oid":
+			oid, ok := strings.CutPrefix(value, "sha256:")
+			if !ok || !validLFSOID(oid) {
+				return p, false
+			}
+			p.OID = oid
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return p, false
+			}
+			p.Size = size
+		}
+	}
+
+	return p, p.OID != ""
+}
+
+// validLFSOID reports whether oid is a sha256 in lowercase hex, anything else
+// must never be made into a path
+func validLFSOID(oid string) bool {
+	if len(oid) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range oid {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Encode returns the content of the pointer file
+func (p LFSPointer) Encode() []byte {
+	return []byte(fmt.Sprintf("version %s\noid sha256:%s\nsize %d\n", lfsPointerVersion, p.OID, p.Size))
+}
+
+// lfsObject is an object as named in batch requests and responses
+type lfsObject struct {
+	OID     string               `json:"oid"`
+	Size    int64                `json:"size"`
+	Actions map[string]lfsAction `json:"actions,omitempty"`
+	Error   *lfsError            `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []lfsObject `json:"objects"`
+	HashAlgo  string      `json:"hash_algo"`
+}
+
+type lfsBatchResponse struct {
+	Objects []lfsObject `json:"objects"`
+	Message string      `json:"message"`
+}
+
+// IsLFSPath reports whether .gitattributes puts p in Git LFS
+func (m *Manager) IsLFSPath(p string) bool {
+	m.lfsMu.Lock()
+	defer m.lfsMu.Unlock()
+
+	if m.lfsMatcher == nil {
+		var attrs []gitattributes.MatchAttribute
+		wt, err := m.repository.Worktree()
+		if err == nil {
+			attrs, err = gitattributes.ReadPatterns(wt.Filesystem, nil)
+		}
+		if err != nil {
+			log.Printf("Error reading .gitattributes: %v", err)
+		}
+		m.lfsMatcher = gitattributes.NewMatcher(attrs)
+	}
+
+	results, _ := m.lfsMatcher.Match(strings.Split(p, "/"), []string{"filter"})
+	filter, ok := results["filter"]
+	return ok && filter.IsValueSet() && filter.Value() == "lfs"
+}
+
+// resetLFSAttributes makes the next lookup read .gitattributes again
+func (m *Manager) resetLFSAttributes() {
+	m.lfsMu.Lock()
+	defer m.lfsMu.Unlock()
+	m.lfsMatcher = nil
+}
+
+// LFSPointer returns the pointer content holds when p is stored in Git LFS
+func (m *Manager) LFSPointer(p string, content []byte) (LFSPointer, bool) {
+	pointer, ok := ParseLFSPointer(content)
+	if !ok || !m.IsLFSPath(p) {
+		return LFSPointer{}, false
+	}
+	return pointer, true
+}
+
+// OpenLFS opens the content a pointer stands for, fetching it from the LFS
+// server into the local object store unless it is there already
+func (m *Manager) OpenLFS(ctx context.Context, pointer LFSPointer) (*os.File, error) {
+	p, err := m.lfsObjectPath(pointer.OID)
+	if err != nil {
+		return nil, err
+	}
+	if f, err := os.Open(p); err == nil {
+		return f, nil
+	}
+
+	if err := m.downloadLFS(ctx, pointer); err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// downloadLFS streams an object from the LFS server into the local store
+func (m *Manager) downloadLFS(ctx context.Context, pointer LFSPointer) error {
+	p, err := m.lfsObjectPath(pointer.OID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Fetching LFS object %s (%d bytes)", pointer.OID, pointer.Size)
+
+	objects, err := m.lfsBatch(ctx, "download", []lfsObject{{OID: pointer.OID, Size: pointer.Size}})
+	if err != nil {
+		return err
+	}
+	if len(objects) != 1 || objects[0].OID != pointer.OID {
+		return fmt.Errorf("lfs: no answer for object %s", pointer.OID)
+	}
+	action, ok := objects[0].Actions["download"]
+	if !ok {
+		return fmt.Errorf("lfs: object %s cannot be downloaded", pointer.OID)
+	}
+
+	ctx, cancel := lfsTransferContext(ctx, pointer.Size)
+	defer cancel()
+	resp, err := m.lfsDo(ctx, "GET", action, nil, -1, "")
+	if err != nil {
+		return fmt.Errorf("lfs download %s: %w", pointer.OID, err)
+	}
+	defer resp.Body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), pointer.OID+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(resp.Body, pointer.Size+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("lfs download %s: %w", pointer.OID, err)
+	}
+	if n != pointer.Size || hex.EncodeToString(h.Sum(nil)) != pointer.OID {
+		return fmt.Errorf("lfs download %s: content does not match the pointer", pointer.OID)
+	}
+
+	return os.Rename(tmp.Name(), p)
+}
+
+// CleanLFS moves content into the local LFS object store when p is kept in
+// Git LFS and returns the pointer to write to the worktree instead, the
+// pointer is nil for other files. The object stays local until the next push
+// uploads it.
+func (m *Manager) CleanLFS(p string, content io.Reader) (*LFSPointer, error) {
+	if !m.IsLFSPath(p) {
+		return nil, nil
+	}
+
+	r := bufio.NewReaderSize(content, LFSMaxPointerSize+1)
+	if head, _ := r.Peek(LFSMaxPointerSize + 1); len(head) <= LFSMaxPointerSize {
+		if _, ok := ParseLFSPointer(head); ok {
+			return nil, nil // Already a pointer
+		}
+	}
+
+	if err := os.MkdirAll(m.lfsDir, 0700); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(m.lfsDir, "clean-")
+	if err != nil {
+		return nil, fmt.Errorf("lfs: store %s: %w", p, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lfs: store %s: %w", p, err)
+	}
+
+	pointer := LFSPointer{OID: hex.EncodeToString(h.Sum(nil)), Size: size}
+	objectPath, err := m.lfsObjectPath(pointer.OID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), objectPath); err != nil {
+		return nil, fmt.Errorf("lfs: store %s: %w", p, err)
+	}
+
+	m.lfsMu.Lock()
+	m.lfsPending[pointer.OID] = pointer.Size
+	m.lfsMu.Unlock()
+
+	return &pointer, nil
+}
+
+// uploadLFS uploads the objects cleaned since the last upload
+func (m *Manager) uploadLFS(ctx context.Context) error {
+	m.lfsMu.Lock()
+	var objects []lfsObject
+	for oid, size := range m.lfsPending {
+		objects = append(objects, lfsObject{OID: oid, Size: size})
+	}
+	m.lfsMu.Unlock()
+
+	if len(objects) == 0 {
+		return nil
+	}
+
+	log.Printf("Uploading %d LFS objects", len(objects))
+
+	batch, err := m.lfsBatch(ctx, "upload", objects)
+	if err != nil {
+		return err
+	}
+
+	// Pointers to an object the server did not answer for must not be
+	// pushed
+	answered := map[string]bool{}
+	for _, object := range batch {
+		answered[object.OID] = true
+	}
+	for _, object := range objects {
+		if !answered[object.OID] {
+			return fmt.Errorf("lfs upload %s: missing from the batch response", object.OID)
+		}
+	}
+
+	for _, object := range batch {
+		if err := m.uploadLFSObject(ctx, object); err != nil {
+			return err
+		}
+
+		// Objects without actions are already on the server
+		m.lfsMu.Lock()
+		delete(m.lfsPending, object.OID)
+		m.lfsMu.Unlock()
+	}
+
+	return nil
+}
+
+// uploadLFSObject runs the upload and verify actions the server asked for
+func (m *Manager) uploadLFSObject(ctx context.Context, object lfsObject) error {
+	ctx, cancel := lfsTransferContext(ctx, object.Size)
+	defer cancel()
+
+	if action, ok := object.Actions["upload"]; ok {
+		p, err := m.lfsObjectPath(object.OID)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("lfs upload %s: %w", object.OID, err)
+		}
+		resp, err := m.lfsDo(ctx, "PUT", action, f, object.Size, "application/octet-stream")
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("lfs upload %s: %w", object.OID, err)
+		}
+		resp.Body.Close()
+	}
+
+	if action, ok := object.Actions["verify"]; ok {
+		body, _ := json.Marshal(lfsObject{OID: object.OID, Size: object.Size})
+		resp, err := m.lfsDo(ctx, "POST", action, bytes.NewReader(body), int64(len(body)), lfsMediaType)
+		if err != nil {
+			return fmt.Errorf("lfs verify %s: %w", object.OID, err)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// lfsBatch runs a batch API request and checks the per object errors
+func (m *Manager) lfsBatch(ctx context.Context, operation string, objects []lfsObject) ([]lfsObject, error) {
+	endpoint, err := m.lfsEndpoint(operation)
+	if err != nil {
+		return nil, fmt.Errorf("lfs: %w", err)
+	}
+
+	body, err := json.Marshal(lfsBatchRequest{
+		Operation: operation,
+		Transfers: []string{"basic"},
+		Objects:   objects,
+		HashAlgo:  "sha256",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lfsBatchTimeout)
+	defer cancel()
+
+	endpoint.Href = strings.TrimSuffix(endpoint.Href, "/") + "/objects/batch"
+	resp, err := m.lfsDo(ctx, "POST", endpoint, bytes.NewReader(body), int64(len(body)), lfsMediaType)
+	if err != nil {
+		return nil, fmt.Errorf("lfs batch %s: %w", operation, err)
+	}
+	defer resp.Body.Close()
+
+	var batch lfsBatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("lfs batch %s: %w", operation, err)
+	}
+
+	for _, object := range batch.Objects {
+		if object.Error != nil {
+			return nil, fmt.Errorf("lfs %s %s: %d %s", operation, object.OID, object.Error.Code, object.Error.Message)
+		}
+	}
+
+	return batch.Objects, nil
+}
+
+// lfsDo sends a request for an action and fails on non 2xx responses, size
+// is the length of body or -1 without one. The response body has to be read
+// before ctx is done.
+func (m *Manager) lfsDo(ctx context.Context, method string, action lfsAction, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, action.Href, body)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range action.Header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := lfsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var e lfsBatchResponse
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e)
+		if e.Message != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, e.Message)
+		}
+		return nil, errors.New(resp.Status)
+	}
+	return resp, nil
+}
+
+// lfsEndpoint works out the LFS server like git-lfs does: the configured
+// url, lfs.url from .lfsconfig or the git config, or derived from the remote
+// url. SSH remotes are asked for the endpoint with git-lfs-authenticate.
+func (m *Manager) lfsEndpoint(operation string) (lfsAction, error) {
+	if m.lfsURL != "" {
+		return lfsAction{Href: m.lfsURL}, nil
+	}
+
+	if wt, err := m.repository.Worktree(); err == nil {
+		if f, err := wt.Filesystem.Open(lfsConfigFile); err == nil {
+			conf := config.NewConfig()
+			data, err := io.ReadAll(f)
+			f.Close()
+			if err == nil && conf.Unmarshal(data) == nil {
+				if href := conf.Raw.Section("lfs").Option("url"); href != "" {
+					return lfsAction{Href: href}, nil
+				}
+			}
+		}
+	}
+
+	conf, err := m.repository.Config()
+	if err != nil {
+		return lfsAction{}, err
+	}
+	if href := conf.Raw.Section("lfs").Option("url"); href != "" {
+		return lfsAction{Href: href}, nil
+	}
+
+	remote, ok := conf.Remotes["origin"]
+	if !ok || len(remote.URLs) == 0 {
+		return lfsAction{}, errors.New("no lfs url configured and no origin remote")
+	}
+	ep, err := transport.NewEndpoint(remote.URLs[0])
+	if err != nil {
+		return lfsAction{}, err
+	}
+
+	switch ep.Protocol {
+	case "http", "https":
+		href := *ep
+		href.Path = lfsRepoPath(ep.Path)
+		return lfsAction{Href: href.String()}, nil
+	case "ssh":
+		return m.lfsAuthenticate(ep, operation)
+	default:
+		return lfsAction{}, fmt.Errorf("no lfs url configured for %s remote", ep.Protocol)
+	}
+}
+
+// lfsRepoPath returns the LFS path of a repository path
+func lfsRepoPath(p string) string {
+	if !strings.HasSuffix(p, ".git") {
+		p += ".git"
+	}
+	return path.Join(p, "info/lfs")
+}
+
+// lfsAuthenticate runs git-lfs-authenticate on an SSH remote, which answers
+// with the LFS endpoint and the headers to use
+func (m *Manager) lfsAuthenticate(ep *transport.Endpoint, operation string) (lfsAction, error) {
+	auth, err := m.auth()
+	if err != nil {
+		return lfsAction{}, err
+	}
+	sshAuth, ok := auth.(gitssh.AuthMethod)
+	if !ok {
+		return lfsAction{}, errors.New("unsupported ssh auth method")
+	}
+	clientConfig, err := sshAuth.ClientConfig()
+	if err != nil {
+		return lfsAction{}, err
+	}
+	if ep.User != "" {
+		clientConfig.User = ep.User
+	}
+	clientConfig.Timeout = 30 * time.Second
+
+	port := ep.Port
+	if port == 0 {
+		port = 22
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort(ep.Host, strconv.Itoa(port)), clientConfig)
+	if err != nil {
+		return lfsAction{}, fmt.Errorf("git-lfs-authenticate: %w", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return lfsAction{}, fmt.Errorf("git-lfs-authenticate: %w", err)
+	}
+	defer session.Close()
+
+	out, err := session.Output(fmt.Sprintf("git-lfs-authenticate %s %s", strings.TrimPrefix(ep.Path, "/"), operation))
+	if err != nil {
+		return lfsAction{}, fmt.Errorf("git-lfs-authenticate: %w", err)
+	}
+
+	var action lfsAction
+	if err := json.Unmarshal(out, &action); err != nil {
+		return lfsAction{}, fmt.Errorf("git-lfs-authenticate: %w", err)
+	}
+	if action.Href == "" {
+		action.Href = "https://" + ep.Host + "/" + lfsRepoPath(strings.TrimPrefix(ep.Path, "/"))
+	}
+	return action, nil
+}
+
+// lfsObjectPath is where an object is kept locally, laid out like
+// .git/lfs/objects. Oids come from pointers in the repository and from the
+// server, so they are checked before they go anywhere near the filesystem.
+func (m *Manager) lfsObjectPath(oid string) (string, error) {
+	if !validLFSOID(oid) {
+		return "", fmt.Errorf("lfs: invalid object id %q", oid)
+	}
+	return filepath.Join(m.lfsDir, oid[0:2], oid[2:4], oid), nil
+}
+
+// isAttributesFile reports whether p changes which files are in Git LFS
+func isAttributesFile(p string) bool {
+	return path.Base(p) == ".gitattributes"
+}
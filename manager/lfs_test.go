@@ -0,0 +1,238 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// lfsServer is a stand-in for a Git LFS server speaking the batch API with
+// basic transfers
+type lfsServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	stall   bool
+	omit    bool
+	stop    chan struct{}
+}
+
+func newLFSServer(t *testing.T) *lfsServer {
+	s := &lfsServer{objects: map[string][]byte{}, stop: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /objects/batch", s.batch)
+	mux.HandleFunc("GET /objects/{oid}", s.download)
+	mux.HandleFunc("PUT /objects/{oid}", s.upload)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(func() {
+		close(s.stop)
+		s.Close()
+	})
+	return s
+}
+
+func (s *lfsServer) batch(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	stall := s.stall
+	s.mu.Unlock()
+	if stall {
+		<-s.stop
+		return
+	}
+
+	var req lfsBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp lfsBatchResponse
+	s.mu.Lock()
+	for _, object := range req.Objects {
+		_, stored := s.objects[object.OID]
+		href := lfsAction{Href: s.URL + "/objects/" + object.OID}
+		switch {
+		case req.Operation == "download" && stored:
+			object.Actions = map[string]lfsAction{"download": href}
+		case req.Operation == "download":
+			object.Error = &lfsError{Code: http.StatusNotFound, Message: "not found"}
+		case req.Operation == "upload" && !stored:
+			object.Actions = map[string]lfsAction{"upload": href}
+		}
+		if s.omit {
+			continue
+		}
+		resp.Objects = append(resp.Objects, object)
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", lfsMediaType)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *lfsServer) download(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	content, ok := s.objects[r.PathValue("oid")]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(content)
+}
+
+func (s *lfsServer) upload(w http.ResponseWriter, r *http.Request) {
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.objects[r.PathValue("oid")] = content
+	s.mu.Unlock()
+}
+
+// newLFSManager returns a manager keeping *.bin in LFS on server
+func newLFSManager(t *testing.T, server *lfsServer) *Manager {
+	wt := memfs.New()
+	if err := util.WriteFile(wt, ".gitattributes", []byte("*.bin filter=lfs diff=lfs merge=lfs -text\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := git.Init(memory.NewStorage(), wt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Manager{
+		repository: repo,
+		lfsDir:     t.TempDir(),
+		lfsURL:     server.URL,
+		lfsPending: map[string]int64{},
+	}
+}
+
+func TestLFSCleanUploadSmudge(t *testing.T) {
+	server := newLFSServer(t)
+	m := newLFSManager(t, server)
+	content := bytes.Repeat([]byte("large file content\n"), 1000)
+
+	// Files outside of LFS are left alone
+	if pointer, err := m.CleanLFS("a.txt", bytes.NewReader(content)); err != nil || pointer != nil {
+		t.Fatalf("CleanLFS(a.txt) = %v, %v, want no pointer", pointer, err)
+	}
+
+	pointer, err := m.CleanLFS("a.bin", bytes.NewReader(content))
+	if err != nil || pointer == nil {
+		t.Fatalf("CleanLFS(a.bin) = %v, %v", pointer, err)
+	}
+	if pointer.Size != int64(len(content)) {
+		t.Errorf("pointer size = %d, want %d", pointer.Size, len(content))
+	}
+	parsed, ok := m.LFSPointer("a.bin", pointer.Encode())
+	if !ok || parsed != *pointer {
+		t.Errorf("LFSPointer(Encode()) = %v, %v, want %v", parsed, ok, *pointer)
+	}
+
+	// A pointer is not cleaned again
+	if again, err := m.CleanLFS("a.bin", bytes.NewReader(pointer.Encode())); err != nil || again != nil {
+		t.Errorf("CleanLFS(pointer) = %v, %v, want no pointer", again, err)
+	}
+
+	if err := m.uploadLFS(context.Background()); err != nil {
+		t.Fatalf("uploadLFS: %v", err)
+	}
+	if !bytes.Equal(server.objects[pointer.OID], content) {
+		t.Fatalf("server holds %d bytes for %s, want the content", len(server.objects[pointer.OID]), pointer.OID)
+	}
+	if len(m.lfsPending) != 0 {
+		t.Errorf("%d objects still pending after upload", len(m.lfsPending))
+	}
+
+	// A manager without the object in its store fetches it
+	other := newLFSManager(t, server)
+	f, err := other.OpenLFS(context.Background(), *pointer)
+	if err != nil {
+		t.Fatalf("OpenLFS: %v", err)
+	}
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("OpenLFS read %d bytes, want the content", len(got))
+	}
+}
+
+func TestLFSDownloadMismatch(t *testing.T) {
+	server := newLFSServer(t)
+	m := newLFSManager(t, server)
+
+	pointer := LFSPointer{OID: strings.Repeat("ab", 32), Size: 5}
+	server.objects[pointer.OID] = []byte("other")
+	if f, err := m.OpenLFS(context.Background(), pointer); err == nil {
+		f.Close()
+		t.Fatal("OpenLFS served content that does not match the pointer")
+	}
+}
+
+func TestLFSUploadMissingFromBatch(t *testing.T) {
+	server := newLFSServer(t)
+	server.omit = true
+	m := newLFSManager(t, server)
+
+	pointer, err := m.CleanLFS("a.bin", strings.NewReader("content"))
+	if err != nil || pointer == nil {
+		t.Fatalf("CleanLFS(a.bin) = %v, %v", pointer, err)
+	}
+	if err := m.uploadLFS(context.Background()); err == nil {
+		t.Fatal("uploadLFS succeeded without the server answering for the object")
+	}
+	if _, ok := m.lfsPending[pointer.OID]; !ok {
+		t.Error("the object is no longer pending")
+	}
+}
+
+func TestLFSStalledServer(t *testing.T) {
+	server := newLFSServer(t)
+	server.stall = true
+	m := newLFSManager(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	pointer := LFSPointer{OID: strings.Repeat("0", 64), Size: 1}
+	if _, err := m.OpenLFS(ctx, pointer); err == nil {
+		t.Fatal("OpenLFS succeeded against a stalled server")
+	}
+}
+
+func TestParseLFSPointerRejectsBadOIDs(t *testing.T) {
+	for _, oid := range []string{
+		"../../..//etc/shadow" + strings.Repeat("a", 44),
+		strings.Repeat("A", 64),
+		strings.Repeat("g", 64),
+		strings.Repeat("a", 63),
+	} {
+		data := []byte("version " + lfsPointerVersion + "\noid sha256:" + oid + "\nsize 1\n")
+		if p, ok := ParseLFSPointer(data); ok {
+			t.Errorf("ParseLFSPointer accepted oid %q: %v", oid, p)
+		}
+	}
+
+	m := &Manager{lfsDir: t.TempDir()}
+	if _, err := m.OpenLFS(context.Background(), LFSPointer{OID: "../../../../../../../etc/passwd"}); err == nil {
+		t.Error("OpenLFS opened a path outside of the object store")
+	}
+}
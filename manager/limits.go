@@ -0,0 +1,224 @@
+package manager
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// binarySniffLen is how much of a file is looked at to decide whether it is
+// binary, the same amount git uses
+const binarySniffLen = 8000
+
+// Limits bounds what may be written to the mount and committed, zero values
+// mean no limit
+type Limits struct {
+	// MaxFileSize is the largest a single file may grow, writes beyond it
+	// fail with EFBIG
+	MaxFileSize int64
+
+	// MaxCommitSize is the largest total size of the files changed by a
+	// single commit
+	MaxCommitSize int64
+
+	// MaxRepoSize is the largest the worktree may grow in total, writes
+	// beyond it fail with ENOSPC. It is the size the mount reports.
+	MaxRepoSize int64
+
+	// RefuseBinary refuses to commit binary files unless they match one of
+	// the gitignore style patterns in AllowBinary
+	RefuseBinary bool
+	AllowBinary  []string
+}
+
+// LimitError is returned when staged changes break the configured limits,
+// nothing is committed until the offending files change
+type LimitError struct {
+	Problems []string
+}
+
+func (e *LimitError) Error() string {
+	return "changes exceed the mount limits:\n" + strings.Join(e.Problems, "\n")
+}
+
+// FileSizeAllowed reports whether a file may grow to size bytes
+func (m *Manager) FileSizeAllowed(size int64) bool {
+	return m.limits.MaxFileSize <= 0 || size <= m.limits.MaxFileSize
+}
+
+// usageTTL is how long a worktree usage count is reused, counting walks the
+// whole worktree
+const usageTTL = time.Second
+
+// Usage is how much the worktree holds
+type Usage struct {
+	Bytes int64
+	Files int64
+}
+
+// Usage returns the total size of the files in the worktree and how many
+// files and directories there are
+func (m *Manager) Usage() Usage {
+	m.usageMu.Lock()
+	defer m.usageMu.Unlock()
+
+	if time.Since(m.usageTime) < usageTTL {
+		return m.usage
+	}
+
+	wt, err := m.repository.Worktree()
+	if err != nil {
+		log.Printf("Error counting worktree usage: %v", err)
+		return m.usage
+	}
+	var usage Usage
+	if err := countUsage(wt.Filesystem, "", &usage); err != nil {
+		log.Printf("Error counting worktree usage: %v", err)
+		return m.usage
+	}
+	m.usage = usage
+	m.usageTime = time.Now()
+	return usage
+}
+
+func countUsage(fs billy.Filesystem, dir string, usage *Usage) error {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		usage.Files++
+		if entry.IsDir() {
+			if err := countUsage(fs, path.Join(dir, entry.Name()), usage); err != nil {
+				return err
+			}
+			continue
+		}
+		usage.Bytes += entry.Size()
+	}
+	return nil
+}
+
+// MaxRepoSize returns the limit on the worktree size, zero is no limit
+func (m *Manager) MaxRepoSize() int64 {
+	return m.limits.MaxRepoSize
+}
+
+// RepoSizeAllowed reports whether the worktree may grow by growth bytes
+func (m *Manager) RepoSizeAllowed(growth int64) bool {
+	if m.limits.MaxRepoSize <= 0 || growth <= 0 {
+		return true
+	}
+	return m.Usage().Bytes+growth <= m.limits.MaxRepoSize
+}
+
+// checkLimitsLocked checks the files staged for the next commit against the
+// limits
+func (m *Manager) checkLimitsLocked() error {
+	if m.limits.MaxFileSize <= 0 && m.limits.MaxCommitSize <= 0 && !m.limits.RefuseBinary {
+		return nil
+	}
+
+	idx, err := m.repository.Storer.Index()
+	if err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+
+	var tree *object.Tree
+	if head, err := m.repository.Head(); err == nil {
+		if commit, err := m.repository.CommitObject(head.Hash()); err == nil {
+			tree, _ = commit.Tree()
+		}
+	}
+
+	var allowed gitignore.Matcher
+	if m.limits.RefuseBinary {
+		var patterns []gitignore.Pattern
+		for _, p := range m.limits.AllowBinary {
+			patterns = append(patterns, gitignore.ParsePattern(p, nil))
+		}
+		allowed = gitignore.NewMatcher(patterns)
+	}
+
+	var problems []string
+	var total int64
+	for _, entry := range idx.Entries {
+		if entry.Mode == filemode.Submodule {
+			continue
+		}
+		if tree != nil {
+			if old, err := tree.FindEntry(entry.Name); err == nil && old.Hash == entry.Hash {
+				continue // Unchanged
+			}
+		}
+
+		// The index only has the low 32 bits of the size
+		size, err := m.blobSize(entry.Hash)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", entry.Name, err)
+		}
+		total += size
+		if m.limits.MaxFileSize > 0 && size > m.limits.MaxFileSize {
+			problems = append(problems, fmt.Sprintf("%s: %d bytes is over the file size limit of %d", entry.Name, size, m.limits.MaxFileSize))
+		}
+
+		if allowed != nil && !allowed.Match(strings.Split(entry.Name, "/"), false) {
+			binary, err := m.isBinaryBlob(entry.Hash)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", entry.Name, err)
+			}
+			if binary {
+				problems = append(problems, fmt.Sprintf("%s: binary files are not allowed here", entry.Name))
+			}
+		}
+	}
+
+	if m.limits.MaxCommitSize > 0 && total > m.limits.MaxCommitSize {
+		problems = append(problems, fmt.Sprintf("commit: %d bytes is over the commit size limit of %d", total, m.limits.MaxCommitSize))
+	}
+
+	if len(problems) > 0 {
+		return &LimitError{Problems: problems}
+	}
+	return nil
+}
+
+// blobSize returns the size of a staged blob
+func (m *Manager) blobSize(hash plumbing.Hash) (int64, error) {
+	obj, err := m.repository.Storer.EncodedObject(plumbing.BlobObject, hash)
+	if err != nil {
+		return 0, err
+	}
+	return obj.Size(), nil
+}
+
+// isBinaryBlob reports whether the blob of an index entry holds a NUL byte
+// near its start, which is how git tells binary files apart
+func (m *Manager) isBinaryBlob(hash plumbing.Hash) (bool, error) {
+	blob, err := m.repository.BlobObject(hash)
+	if err != nil {
+		return false, err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	buf := make([]byte, binarySniffLen)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return bytes.IndexByte(buf[:n], 0) >= 0, nil
+}
@@ -0,0 +1,58 @@
+package manager
+
+import "log"
+
+// LockFile records a write lock on p. A write locked file is left out of
+// commits, its content may be halfway through an update. Once the lock is
+// released the file is committed with the next change.
+func (m *Manager) LockFile(p string) {
+	m.lockMu.Lock()
+	defer m.lockMu.Unlock()
+
+	if m.writeLocks == nil {
+		m.writeLocks = map[string]int{}
+	}
+	m.writeLocks[p]++
+}
+
+// UnlockFile drops a write lock recorded with LockFile
+func (m *Manager) UnlockFile(p string) {
+	m.lockMu.Lock()
+	if m.writeLocks[p] > 1 {
+		m.writeLocks[p]--
+		m.lockMu.Unlock()
+		return
+	}
+	delete(m.writeLocks, p)
+	skipped := m.lockSkipped[p]
+	delete(m.lockSkipped, p)
+	m.lockMu.Unlock()
+
+	// What was left out is committed with the next sync
+	if skipped {
+		m.NotifyChange(p, "unlock")
+	}
+}
+
+// skipLockedLocked reports whether p is write locked and has to be left out
+// of the commit, lockMu has to be held until the commit is staged so that no
+// lock is taken halfway through
+func (m *Manager) skipLockedLocked(p string) bool {
+	if m.writeLocks[p] == 0 {
+		return false
+	}
+	log.Printf("Not committing %s while it is write locked", p)
+	if m.lockSkipped == nil {
+		m.lockSkipped = map[string]bool{}
+	}
+	m.lockSkipped[p] = true
+	return true
+}
+
+// dropLocks forgets every write lock, once unmounted nobody can hold one
+func (m *Manager) dropLocks() {
+	m.lockMu.Lock()
+	defer m.lockMu.Unlock()
+	m.writeLocks = nil
+	m.lockSkipped = nil
+}
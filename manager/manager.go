@@ -1,22 +1,70 @@
 package manager
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"strings"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/gitattributes"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
 )
 
 // ChangeNotification represents a file system change
 type ChangeNotification struct {
-	Path      string
-	Operation string // "create", "write", "delete", etc.
-	Time      time.Time
+	Path      string    `json:"path"`
+	Operation string    `json:"operation"` // "create", "write", "delete", etc.
+	Time      time.Time `json:"time"`
+
+	// From is the old path of a rename
+	From string `json:"from,omitempty"`
+}
+
+// DefaultCommitMessage is used for commits when no message has been set
+const DefaultCommitMessage = "Auto-commit from gittyfs"
+
+// ErrReadOnly is returned when a read-only manager is asked to commit
+var ErrReadOnly = errors.New("read-only mount")
+
+// The identity commits are made as when neither the options nor the git
+// config name one
+const (
+	defaultAuthorName  = "gittyfs"
+	defaultAuthorEmail = "gittyfs@example.com"
+)
+
+// CommitMode controls when changes are committed and pushed
+type CommitMode string
+
+const (
+	// CommitModeAuto commits and pushes once the filesystem has been quiet
+	// for the sync interval
+	CommitModeAuto CommitMode = "auto"
+	// CommitModeManual only commits and pushes on a checkpoint
+	CommitModeManual CommitMode = "manual"
+	// CommitModeSquash commits automatically but only pushes on a
+	// checkpoint, squashing the local commits into one
+	CommitModeSquash CommitMode = "squash"
+)
+
+// ParseCommitMode parses a commit mode, the empty string is auto
+func ParseCommitMode(s string) (CommitMode, error) {
+	switch mode := CommitMode(s); mode {
+	case "":
+		return CommitModeAuto, nil
+	case CommitModeAuto, CommitModeManual, CommitModeSquash:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown commit mode %q", s)
+	}
 }
 
 type Manager struct {
@@ -27,27 +75,282 @@ type Manager struct {
 	isDirty        bool
 	lastChangeTime time.Time
 	syncInterval   time.Duration
+	commitMode     CommitMode
+	pushed         plumbing.Hash
+	queued         plumbing.Hash
+	pushRequests   chan struct{}
+	syncRequests   chan struct{}
+	ignore         []string
+	ignoreMatcher  gitignore.Matcher
+	hooks          []string
+	hookDir        string
+	hookFiles      map[string]hookFile
+	syncBlocked    time.Time
+	secretRules    []secretRule
+	limits         Limits
+	lfsURL         string
+	lfsDir         string
+	lfsMu          sync.Mutex
+	lfsMatcher     gitattributes.Matcher
+	lfsPending     map[string]int64
+	options        Options
+	onPush         func(plumbing.Hash)
+	subMu          sync.Mutex
+	submodules     map[string]*Manager
+	gitlinks       map[string]plumbing.Hash
+	partial        *PartialStorage
+	usageMu        sync.Mutex
+	usage          Usage
+	usageTime      time.Time
+	lockMu         sync.Mutex
+	writeLocks     map[string]int
+	lockSkipped    map[string]bool
+	signingKey     string
+	signingFormat  SigningFormat
+	authorName     string
+	authorEmail    string
+	signer         git.Signer
+	stopOnce       sync.Once
+	done           chan struct{}
+	stopped        chan struct{}
+
+	// state is guarded by its own lock so that status queries never
+	// have to wait for a sync or fetch holding mu
+	stateMu sync.RWMutex
+	state   state
+}
+
+// Options configures a Manager, the zero value gives the defaults
+type Options struct {
+	// SyncInterval is how long the filesystem has to be quiet before
+	// changes are committed and pushed
+	SyncInterval time.Duration
+
+	// Paused starts the manager with automatic sync paused
+	Paused bool
+
+	// CommitMode controls when changes are committed and pushed, the
+	// default is CommitModeAuto
+	CommitMode CommitMode
+
+	// Ignore holds gitignore style patterns for files that are never
+	// committed, on top of .gitignore and .git/info/exclude
+	Ignore []string
+
+	// SigningKey signs commits when set, it is the path of an armored
+	// OpenPGP private key or, for SSH, a private key, a public key held by
+	// ssh-agent or a literal "key::" public key. When empty user.signingkey
+	// and gpg.format from the git config are used.
+	SigningKey    string
+	SigningFormat SigningFormat
+
+	// AuthorName and AuthorEmail are who commits are made as, when empty
+	// user.name and user.email from the git config are used. Signed commits
+	// only show as verified when they match the identity of the signing
+	// key.
+	AuthorName  string
+	AuthorEmail string
+
+	// PreCommit holds shell commands run against a checkout of the staged
+	// tree before every commit, any failing command blocks the commit.
+	// When empty and RepoHooks is set the repository's own
+	// .githooks/pre-commit is run if there is one, it comes from the remote
+	// so it must be trusted like code you run yourself.
+	PreCommit []string
+	RepoHooks bool
+
+	// SecretPatterns holds regular expressions for secrets on top of the
+	// built in ones, commits adding a matching line are quarantined
+	// locally instead of being pushed. NoSecretScan turns the scan off.
+	SecretPatterns []string
+	NoSecretScan   bool
+
+	// Limits bounds file and commit sizes and which files may be binary
+	Limits Limits
+
+	// LFSURL is the Git LFS server, when empty it is found like git-lfs
+	// does from lfs.url or the remote url
+	LFSURL string
+
+	// Dir is the directory the repository was cloned into, submodules are
+	// cloned and Git LFS objects kept below it. When empty they go to the
+	// temporary directory.
+	Dir string
+
+	// OnPush is called with the pushed commit after every successful push
+	OnPush func(plumbing.Hash)
+
+	// ReadOnly makes the manager refuse every change, the mount keeps
+	// serving the commit it was cloned at and nothing is committed or
+	// pushed. Fetch still updates the remote tracking references but the
+	// worktree is never moved to them.
+	ReadOnly bool
+
+	// PushBranch, when set, is a branch template (see ExpandBranch) for a
+	// new branch that commits are made and pushed to, leaving the mounted
+	// branch untouched
+	PushBranch string
+}
+
+func NewManager(repository *git.Repository, authFile string, options Options) (*Manager, error) {
+	syncInterval := options.SyncInterval
+	if syncInterval == 0 {
+		syncInterval = 2 * time.Second // Default 2 second interval
+	}
+
+	commitMode := options.CommitMode
+	if commitMode == "" {
+		commitMode = CommitModeAuto
+	}
+
+	m := &Manager{
+		repository:    repository,
+		authFile:      authFile,
+		changes:       make(chan ChangeNotification, 100), // Buffer size of 100
+		isDirty:       false,
+		syncInterval:  syncInterval,
+		commitMode:    commitMode,
+		ignore:        options.Ignore,
+		hooks:         options.PreCommit,
+		limits:        options.Limits,
+		lfsURL:        options.LFSURL,
+		lfsPending:    map[string]int64{},
+		options:       options,
+		onPush:        options.OnPush,
+		submodules:    map[string]*Manager{},
+		gitlinks:      map[string]plumbing.Hash{},
+		signingKey:    options.SigningKey,
+		signingFormat: options.SigningFormat,
+		pushRequests:  make(chan struct{}, 1),
+		syncRequests:  make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+		state: state{
+			pending: map[string]ChangeNotification{},
+			paused:  options.Paused,
+		},
+	}
+
+	// Partial clones fetch blobs as they are read
+	m.partial, _ = repository.Storer.(*PartialStorage)
+
+	if m.signingKey == "" {
+		m.signingKey, m.signingFormat = signingConfig(repository)
+	}
+	m.authorName, m.authorEmail = identityConfig(repository)
+	if options.AuthorName != "" {
+		m.authorName = options.AuthorName
+	}
+	if options.AuthorEmail != "" {
+		m.authorEmail = options.AuthorEmail
+	}
+
+	// Git LFS objects are kept next to the clone, or in a temporary
+	// directory of their own that goes away on Stop
+	if options.Dir != "" {
+		m.lfsDir = filepath.Join(options.Dir, "lfs")
+		if err := os.MkdirAll(m.lfsDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create lfs object store: %w", err)
+		}
+	} else {
+		lfsDir, err := os.MkdirTemp("", "gittyfs-lfs-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create lfs object store: %w", err)
+		}
+		m.lfsDir = lfsDir
+	}
+
+	if !options.NoSecretScan {
+		rules, err := compileSecretRules(options.SecretPatterns)
+		if err != nil {
+			return nil, err
+		}
+		m.secretRules = rules
+	}
+
+	if options.PushBranch != "" {
+		if err := m.switchBranch(options.PushBranch); err != nil {
+			return nil, err
+		}
+	}
+
+	if head, err := repository.Head(); err == nil {
+		m.pushed = head.Hash()
+		m.state.head = head.Hash()
+		m.state.branch = head.Name().Short()
+	} else {
+		log.Printf("Unable to resolve HEAD: %v", err)
+	}
+
+	return m, nil
 }
 
-func NewManager(repository *git.Repository, authFile string) *Manager {
-	return &Manager{
-		repository:   repository,
-		authFile:     authFile,
-		changes:      make(chan ChangeNotification, 100), // Buffer size of 100
-		isDirty:      false,
-		syncInterval: 2 * time.Second, // Default 5 second interval
+// auth returns the transport auth method used for talking to the remote
+func (m *Manager) auth() (transport.AuthMethod, error) {
+	if m.authFile != "" {
+		authMethod, err := ssh.NewPublicKeysFromFile("git", m.authFile, "")
+		if err != nil {
+			return nil, fmt.Errorf("new public keys from file %s: %w", m.authFile, err)
+		}
+		return authMethod, nil
+	}
+
+	authMethod, err := ssh.NewSSHAgentAuth("git")
+	if err != nil {
+		return nil, fmt.Errorf("new ssh agent auth %s: %w", "git", err)
 	}
+	return authMethod, nil
+}
+
+// ReadOnly reports whether the manager refuses changes
+func (m *Manager) ReadOnly() bool {
+	return m.options.ReadOnly
+}
+
+// BlobHashes returns the blob of every path recorded in the index
+func (m *Manager) BlobHashes() map[string]plumbing.Hash {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	blobs := map[string]plumbing.Hash{}
+	idx, err := m.repository.Storer.Index()
+	if err != nil {
+		log.Printf("Error reading index: %v", err)
+		return blobs
+	}
+	for _, entry := range idx.Entries {
+		blobs[entry.Name] = entry.Hash
+	}
+	return blobs
 }
 
 // NotifyChange sends a notification about a filesystem change
 func (m *Manager) NotifyChange(path, operation string) {
-	notification := ChangeNotification{
+	m.notify(ChangeNotification{
 		Path:      path,
 		Operation: operation,
 		Time:      time.Now(),
+	})
+}
+
+// NotifyRename sends a notification that oldPath was moved to newPath, both
+// are committed together so that git sees a rename
+func (m *Manager) NotifyRename(oldPath, newPath string) {
+	m.notify(ChangeNotification{
+		Path:      newPath,
+		Operation: "rename",
+		Time:      time.Now(),
+		From:      oldPath,
+	})
+}
+
+func (m *Manager) notify(notification ChangeNotification) {
+	if m.options.ReadOnly {
+		log.Printf("Ignoring change to %s (%s), the mount is read-only", notification.Path, notification.Operation)
+		return
 	}
 
-	log.Printf("NotifyChange: %s (%s)", path, operation)
+	log.Printf("NotifyChange: %s (%s)", notification.Path, notification.Operation)
 
 	// Send to channel without blocking if possible
 	select {
@@ -55,12 +358,18 @@ func (m *Manager) NotifyChange(path, operation string) {
 		// Successfully sent
 	default:
 		// Channel buffer is full, log this but don't block
-		fmt.Printf("Warning: change notification buffer is full, dropping change for %s\n", path)
+		fmt.Printf("Warning: change notification buffer is full, dropping change for %s\n", notification.Path)
 	}
 }
 
 // SyncToGit performs the actual git operations
+//
+// In squash mode the commit is kept local until the next checkpoint.
 func (m *Manager) SyncToGit() error {
+	if m.options.ReadOnly {
+		return ErrReadOnly
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -70,6 +379,79 @@ func (m *Manager) SyncToGit() error {
 
 	log.Printf("Syncing changes to git...\n")
 
+	// Commit changes, using the message set by the user if there is one
+	message := m.CommitMessage()
+	if message == "" {
+		message = DefaultCommitMessage
+	}
+	if err := m.commitLocked(message); err != nil {
+		return err
+	}
+
+	if m.commitMode == CommitModeSquash {
+		log.Printf("Changes committed locally, waiting for a checkpoint to push\n")
+		return nil
+	}
+
+	m.queueHeadLocked()
+	if err := m.pushLocked(); err != nil {
+		m.requestPush()
+		return err
+	}
+
+	log.Printf("Changes committed to git\n")
+
+	return nil
+}
+
+// Checkpoint commits everything that changed and pushes it with the given
+// message, in squash mode all local commits since the last push are squashed
+// into a single commit first. An empty message uses the message set with
+// SetCommitMessage, or the default.
+func (m *Manager) Checkpoint(message string) error {
+	err := m.checkpoint(message)
+	m.recordSync(err)
+	return err
+}
+
+func (m *Manager) checkpoint(message string) error {
+	if m.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if message == "" {
+		message = m.CommitMessage()
+	}
+	if message == "" {
+		message = DefaultCommitMessage
+	}
+
+	log.Printf("Checkpoint: %s\n", message)
+
+	if err := m.commitLocked(message); err != nil {
+		return err
+	}
+
+	if m.commitMode == CommitModeSquash {
+		if err := m.squashLocked(message); err != nil {
+			return err
+		}
+	}
+
+	m.queueHeadLocked()
+	if err := m.pushLocked(); err != nil {
+		m.requestPush()
+		return err
+	}
+	return nil
+}
+
+// commitLocked stages and commits everything in the worktree, a clean
+// worktree is not an error
+func (m *Manager) commitLocked(message string) error {
 	conf, err := m.repository.Config()
 	if err != nil {
 		return fmt.Errorf("failed to get repository config: %w", err)
@@ -77,11 +459,11 @@ func (m *Manager) SyncToGit() error {
 
 	log.Printf("Repository config: %+v\n", conf)
 
-	conf.Author.Name = "gittyfs"
-	conf.Author.Email = "gittyfs@example.com"
+	conf.Author.Name = m.authorName
+	conf.Author.Email = m.authorEmail
 
-	conf.Committer.Name = "gittyfs"
-	conf.Committer.Email = "gittyfs@example.com"
+	conf.Committer.Name = m.authorName
+	conf.Committer.Email = m.authorEmail
 
 	err = m.repository.SetConfig(conf)
 	if err != nil {
@@ -94,74 +476,309 @@ func (m *Manager) SyncToGit() error {
 		return fmt.Errorf("failed to get worktree: %w", err)
 	}
 
-	// Add all changes
-	_, err = wt.Add(".")
-	if err != nil {
-		return fmt.Errorf("failed to add changes: %w", err)
-	}
-
-	// Commit changes
-	_, err = wt.Commit("Auto-commit from gittyfs", &git.CommitOptions{})
+	changed, err := m.stageAllLocked(wt)
 	if err != nil {
-		return fmt.Errorf("failed to commit: %w", err)
+		return err
 	}
 
-	var authMethod transport.AuthMethod
-	if m.authFile != "" {
-		authMethod, err = ssh.NewPublicKeysFromFile("git", m.authFile, "")
-		if err != nil {
-			log.Fatalf("new public keys from file %s: %s", m.authFile, err)
+	// Hooks only see the index, so locks need not wait for them
+	if changed > 0 {
+		err = m.checkLimitsLocked()
+		if err == nil {
+			err = m.runHooksLocked()
 		}
-	} else {
-		authMethod, err = ssh.NewSSHAgentAuth("git")
 		if err != nil {
-			log.Fatalf("new ssh agent auth %s: %s", "git", err)
+			// Wait for the next change before trying again
+			m.syncBlocked = m.lastChangeTime
+			return err
 		}
 	}
 
-	err = m.repository.Push(&git.PushOptions{
-		Auth: authMethod,
-	})
+	signer, err := m.signerLocked()
 	if err != nil {
-		return fmt.Errorf("push: %w", err)
+		return fmt.Errorf("failed to load signing key: %w", err)
+	}
+
+	commit, err := wt.Commit(message, &git.CommitOptions{Signer: signer})
+	if errors.Is(err, git.ErrEmptyCommit) {
+		log.Printf("Nothing to commit\n")
+	} else if err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	} else {
+		m.setHead(commit)
+		if err := m.quarantineLocked(commit); err != nil {
+			// Wait for the next change before committing again
+			m.syncBlocked = m.lastChangeTime
+			return err
+		}
+		m.consumeCommitMessage(message)
+		m.updateAheadLocked()
 	}
 
 	// Reset dirty flag
 	m.isDirty = false
-	log.Printf("Changes committed to git\n")
+	m.clearPending()
+
+	return nil
+}
+
+// stageAllLocked records the commits pushed by submodules, then adds all
+// changes that are not ignored or write locked. Locks have to wait until
+// everything is staged, so that what is staged is never halfway through an
+// update.
+func (m *Manager) stageAllLocked(wt *git.Worktree) (int, error) {
+	m.lockMu.Lock()
+	defer m.lockMu.Unlock()
+
+	if err := m.stageGitlinksLocked(); err != nil {
+		return 0, fmt.Errorf("failed to record submodule commits: %w", err)
+	}
+	changed, err := m.stageLocked(wt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add changes: %w", err)
+	}
+	return changed, nil
+}
+
+// squashLocked replaces the commits made since the last checkpoint with a
+// single commit holding the same tree
+func (m *Manager) squashLocked(message string) error {
+	head, err := m.repository.Head()
+	if err != nil {
+		return fmt.Errorf("failed to get head: %w", err)
+	}
+
+	// A checkpoint that is still waiting to be pushed is kept as is
+	base := m.queued
+	if base.IsZero() {
+		base = m.pushed
+	}
+	if base.IsZero() || head.Hash() == base {
+		return nil
+	}
+
+	headCommit, err := m.repository.CommitObject(head.Hash())
+	if err != nil {
+		return fmt.Errorf("failed to get head commit: %w", err)
+	}
+	if len(headCommit.ParentHashes) == 1 && headCommit.ParentHashes[0] == base {
+		return nil // Already a single commit
+	}
+
+	now := time.Now()
+	squashed := &object.Commit{
+		Author:       object.Signature{Name: m.authorName, Email: m.authorEmail, When: now},
+		Committer:    object.Signature{Name: m.authorName, Email: m.authorEmail, When: now},
+		Message:      message,
+		TreeHash:     headCommit.TreeHash,
+		ParentHashes: []plumbing.Hash{base},
+	}
 
+	signer, err := m.signerLocked()
+	if err != nil {
+		return fmt.Errorf("failed to load signing key: %w", err)
+	}
+	if signer != nil {
+		if err := signCommit(signer, squashed); err != nil {
+			return fmt.Errorf("failed to sign squashed commit: %w", err)
+		}
+	}
+
+	obj := m.repository.Storer.NewEncodedObject()
+	if err := squashed.Encode(obj); err != nil {
+		return fmt.Errorf("failed to encode squashed commit: %w", err)
+	}
+	hash, err := m.repository.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return fmt.Errorf("failed to store squashed commit: %w", err)
+	}
+
+	err = m.repository.Storer.SetReference(plumbing.NewHashReference(head.Name(), hash))
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %w", head.Name(), err)
+	}
+
+	log.Printf("Squashed commits since %s into %s\n", base, hash)
+	m.setHead(hash)
+	m.updateAheadLocked()
 	return nil
 }
 
+// Sync forces a sync regardless of the sync interval and records the result,
+// outside of auto mode this is a checkpoint with the current commit message.
+// Changes that were notified but not picked up yet are part of it.
+func (m *Manager) Sync() error {
+	m.drainChanges()
+	if m.commitMode != CommitModeAuto {
+		return m.Checkpoint("")
+	}
+
+	err := m.SyncToGit()
+	m.recordSync(err)
+	return err
+}
+
+// RequestSync makes the running manager sync in the background like Sync
+// does, the result shows up in the status
+func (m *Manager) RequestSync() {
+	select {
+	case m.syncRequests <- struct{}{}:
+	default:
+		// A sync is already requested
+	}
+}
+
+// drainChanges processes the change notifications that are queued
+func (m *Manager) drainChanges() {
+	for {
+		select {
+		case change := <-m.changes:
+			m.processChange(change)
+		default:
+			return
+		}
+	}
+}
+
+// Fetch updates the remote tracking refs from the remote repository
+func (m *Manager) Fetch() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	log.Printf("Fetching from remote...\n")
+
+	authMethod, err := m.auth()
+	if err == nil {
+		if m.partial != nil {
+			err = m.partial.Fetch(m.repository)
+		} else {
+			err = m.repository.Fetch(&git.FetchOptions{
+				Auth: authMethod,
+				Tags: git.NoTags,
+			})
+		}
+		if err == git.NoErrAlreadyUpToDate {
+			err = nil
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("fetch: %w", err)
+	}
+
+	m.recordFetch(err)
+	return err
+}
+
+// Stop stops a running manager, changes that are still pending are synced
+// one last time before it returns. Outside of auto mode they are only
+// logged, checkpoints that were not pushed yet still are.
+func (m *Manager) Stop() {
+	// Submodules go first so that their last commits are recorded here
+	m.stopSubmodules()
+
+	m.stopOnce.Do(func() {
+		close(m.done)
+	})
+	<-m.stopped
+	if m.options.Dir == "" {
+		os.RemoveAll(m.lfsDir)
+	}
+	if m.hookDir != "" {
+		os.RemoveAll(m.hookDir)
+	}
+}
+
+// logUncommitted logs the changes that are left out of every commit
+func (m *Manager) logUncommitted() {
+	for _, change := range m.PendingChanges() {
+		log.Printf("Not committed, no checkpoint was made: %s (%s)\n", change.Path, change.Operation)
+	}
+}
+
+func (m *Manager) processChange(change ChangeNotification) {
+	if change.From != "" {
+		// The old path of a rename is gone whether the new one is ignored
+		// or not
+		m.processChange(ChangeNotification{Path: change.From, Operation: "delete", Time: change.Time})
+	}
+
+	m.mu.Lock()
+	if isAttributesFile(change.Path) {
+		m.resetLFSAttributes()
+	}
+	if isIgnoreFile(change.Path) {
+		m.loadIgnoreLocked()
+	} else if m.isIgnoredLocked(change.Path) {
+		log.Printf("Ignored change: %s (%s)\n", change.Path, change.Operation)
+		m.mu.Unlock()
+		return
+	}
+	m.isDirty = true
+	m.lastChangeTime = change.Time
+	log.Printf("Change detected: %s (%s)\n", change.Path, change.Operation)
+	m.mu.Unlock()
+	m.addPending(change)
+}
+
 func (m *Manager) Run() {
 	log.Printf("Manager running\n")
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
+	defer close(m.stopped)
+
+	if m.options.ReadOnly {
+		// Nothing is ever committed, there is nothing to push or flush
+		<-m.done
+		log.Printf("Manager stopped\n")
+		return
+	}
+
+	go m.pushLoop()
 
 	for {
 		select {
+		case <-m.done:
+			// Pick up whatever is still queued and flush it
+			m.dropLocks()
+			m.drainChanges()
+			var err error
+			if m.commitMode == CommitModeAuto {
+				err = m.SyncToGit()
+				m.recordSync(err)
+			} else {
+				// Outside of auto mode only what was checkpointed is
+				// pushed, the rest was never meant to be committed yet
+				m.mu.Lock()
+				err = m.pushLocked()
+				m.mu.Unlock()
+				m.logUncommitted()
+			}
+			if err != nil {
+				log.Printf("Error syncing to git on stop: %v\n", err)
+			}
+			log.Printf("Manager stopped\n")
+			return
+
 		case change := <-m.changes:
 			// Process the change notification
-			m.mu.Lock()
-			m.isDirty = true
-			m.lastChangeTime = change.Time
-			log.Printf("Change detected: %s (%s)\n", change.Path, change.Operation)
-			m.mu.Unlock()
+			m.processChange(change)
+
+		case <-m.syncRequests:
+			if err := m.Sync(); err != nil {
+				log.Printf("Error syncing to git: %v\n", err)
+			}
 
 		case <-ticker.C:
 			// Check if it's time to sync
 			m.mu.Lock()
-			if m.isDirty && time.Since(m.lastChangeTime) >= m.syncInterval {
+			if m.isDirty && time.Since(m.lastChangeTime) >= m.syncInterval && m.lastChangeTime.After(m.syncBlocked) && !m.Paused() && m.commitMode != CommitModeManual {
 				// Unlock before syncing as SyncToGit will acquire the lock
 				m.mu.Unlock()
-				if err := m.SyncToGit(); err != nil {
-					if strings.Contains(err.Error(), "clean working tree") {
-						log.Printf("Something went wrong earlier, skipping sync")
-						m.isDirty = false
-					} else {
-						log.Printf("Error syncing to git: %v\n", err)
-					}
+				err := m.SyncToGit()
+				if err != nil {
+					log.Printf("Error syncing to git: %v\n", err)
 				}
+				m.recordSync(err)
 			} else {
 				m.mu.Unlock()
 			}
@@ -0,0 +1,582 @@
+package manager
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// DefaultBlobCacheSize is how much memory the blobs fetched by a partial
+// clone may use when no size is given
+const DefaultBlobCacheSize = 64 << 20
+
+// PartialStorage is the object storage of a partial clone. Commits and trees
+// are kept in memory like in a full clone, blobs of the remote are fetched
+// the first time they are read and kept in a least recently used cache.
+// Blobs written locally are stored as usual so that they can be pushed.
+type PartialStorage struct {
+	*memory.Storage
+	url  string
+	auth transport.AuthMethod
+
+	mu       sync.Mutex
+	lru      *list.List // of plumbing.EncodedObject, most recent first
+	cached   map[plumbing.Hash]*list.Element
+	used     int64
+	maxCache int64
+
+	// sizes remembers the size of every blob seen, so that it is still
+	// known once the blob is evicted
+	sizes map[plumbing.Hash]int64
+
+	// spoolDir, when set, holds the content of the objects written that
+	// are larger than spoolSize
+	spoolDir  string
+	spoolSize int64
+}
+
+// NewPartialStorage creates an empty storage fetching blobs from url,
+// cacheSize bounds the memory used by fetched blobs
+func NewPartialStorage(url string, auth transport.AuthMethod, cacheSize int64) *PartialStorage {
+	if cacheSize <= 0 {
+		cacheSize = DefaultBlobCacheSize
+	}
+	return &PartialStorage{
+		Storage:  memory.NewStorage(),
+		url:      url,
+		auth:     auth,
+		lru:      list.New(),
+		cached:   map[plumbing.Hash]*list.Element{},
+		maxCache: cacheSize,
+		sizes:    map[plumbing.Hash]int64{},
+	}
+}
+
+func (s *PartialStorage) NewEncodedObject() plumbing.EncodedObject {
+	if s.spoolDir == "" {
+		return s.Storage.NewEncodedObject()
+	}
+	return newSpoolObject(s.spoolDir, s.spoolSize)
+}
+
+// EncodedObject returns the object with the given hash, blobs missing from
+// the storage are fetched from the remote
+func (s *PartialStorage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := s.Storage.EncodedObject(t, h)
+	if err != plumbing.ErrObjectNotFound || t != plumbing.BlobObject {
+		return obj, err
+	}
+
+	if obj := s.cachedBlob(h); obj != nil {
+		return obj, nil
+	}
+	return s.fetchBlob(h)
+}
+
+// BlobSize returns the size of a blob if it was seen before
+func (s *PartialStorage) BlobSize(h plumbing.Hash) (int64, bool) {
+	if obj, err := s.Storage.EncodedObject(plumbing.BlobObject, h); err == nil {
+		return obj.Size(), true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	size, ok := s.sizes[h]
+	return size, ok
+}
+
+// HasBlob reports whether the content of a blob is at hand without fetching
+// it
+func (s *PartialStorage) HasBlob(h plumbing.Hash) bool {
+	if _, err := s.Storage.EncodedObject(plumbing.BlobObject, h); err == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.cached[h]
+	return ok
+}
+
+func (s *PartialStorage) cachedBlob(h plumbing.Hash) plumbing.EncodedObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.cached[h]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(e)
+	return e.Value.(plumbing.EncodedObject)
+}
+
+// cacheBlob adds a fetched blob to the cache, evicting the least recently
+// used ones to stay within the cache size. A blob bigger than the whole
+// cache is returned to the caller but not kept.
+func (s *PartialStorage) cacheBlob(obj plumbing.EncodedObject) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sizes[obj.Hash()] = obj.Size()
+	if _, ok := s.cached[obj.Hash()]; ok || obj.Size() > s.maxCache {
+		return
+	}
+
+	for s.used+obj.Size() > s.maxCache {
+		last := s.lru.Back()
+		evicted := s.lru.Remove(last).(plumbing.EncodedObject)
+		delete(s.cached, evicted.Hash())
+		s.used -= evicted.Size()
+	}
+
+	s.cached[obj.Hash()] = s.lru.PushFront(obj)
+	s.used += obj.Size()
+}
+
+// fetchBlob fetches a single blob from the remote
+func (s *PartialStorage) fetchBlob(h plumbing.Hash) (plumbing.EncodedObject, error) {
+	log.Printf("Fetching blob %s", h)
+
+	objects := memory.NewStorage()
+	_, _, err := s.uploadPack(func(ar *packp.AdvRefs, req *packp.UploadPackRequest) error {
+		req.Wants = []plumbing.Hash{h}
+		return nil
+	}, objects)
+	if err != nil {
+		return nil, fmt.Errorf("fetch blob %s: %w", h, err)
+	}
+
+	obj, err := objects.EncodedObject(plumbing.BlobObject, h)
+	if err != nil {
+		return nil, fmt.Errorf("fetch blob %s: %w", h, err)
+	}
+	s.cacheBlob(obj)
+	return obj, nil
+}
+
+// uploadPack asks the remote for a pack and stores its objects in objects.
+// build fills in the request from the advertised references, no pack is
+// requested if it leaves the wants empty. The shallow commits sent by the
+// remote are returned.
+func (s *PartialStorage) uploadPack(build func(*packp.AdvRefs, *packp.UploadPackRequest) error, objects storer.Storer) (*packp.AdvRefs, []plumbing.Hash, error) {
+	ep, err := transport.NewEndpoint(s.url)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := client.NewClient(ep)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := c.NewUploadPackSession(ep, s.auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer session.Close()
+
+	ar, err := session.AdvertisedReferences()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req := packp.NewUploadPackRequestFromCapabilities(ar.Capabilities)
+	if err := build(ar, req); err != nil {
+		return nil, nil, err
+	}
+	if len(req.Wants) == 0 {
+		return ar, nil, nil
+	}
+
+	resp, err := session.UploadPack(context.Background(), req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Close()
+
+	var pack io.Reader = resp
+	switch {
+	case req.Capabilities.Supports(capability.Sideband64k):
+		pack = sideband.NewDemuxer(sideband.Sideband64k, resp)
+	case req.Capabilities.Supports(capability.Sideband):
+		pack = sideband.NewDemuxer(sideband.Sideband, resp)
+	}
+	if err := packfile.UpdateObjectStorage(objects, pack); err != nil {
+		return nil, nil, err
+	}
+
+	return ar, resp.Shallows, nil
+}
+
+// ClonePartial clones branch of url, or the remote HEAD when branch is
+// empty, without any blobs. The worktree of the returned repository is a
+// TreeFS listing the tree of the cloned commit, blobs are fetched once
+// files are read. Written files and the objects staged from them that are
+// larger than largeObject are kept in dir, which is left behind for the
+// caller to remove.
+func ClonePartial(url, branch string, auth transport.AuthMethod, cacheSize int64, dir string, largeObject int64) (*git.Repository, error) {
+	return clonePartialCommit(url, branch, plumbing.ZeroHash, auth, cacheSize, dir, largeObject)
+}
+
+// clonePartialCommit is ClonePartial with the branch put on commit instead of
+// the tip of the remote branch, a zero commit is the tip. The remote has to
+// allow fetching a commit that is not the tip.
+func clonePartialCommit(url, branch string, commitHash plumbing.Hash, auth transport.AuthMethod, cacheSize int64, dir string, largeObject int64) (*git.Repository, error) {
+	worktreeDir := filepath.Join(dir, "worktree")
+	objectDir := filepath.Join(dir, "objects")
+	for _, d := range []string{worktreeDir, objectDir} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	s := NewPartialStorage(url, auth, cacheSize)
+	s.spoolDir = objectDir
+	s.spoolSize = largeObject
+
+	var head *plumbing.Reference
+	_, shallows, err := s.uploadPack(func(ar *packp.AdvRefs, req *packp.UploadPackRequest) error {
+		if !ar.Capabilities.Supports(capability.Filter) {
+			return errors.New("the remote does not support partial clones")
+		}
+
+		refs, err := ar.AllReferences()
+		if err != nil {
+			return err
+		}
+		name := plumbing.HEAD
+		if branch != "" {
+			name = plumbing.NewBranchReferenceName(branch)
+		}
+		head, err = storer.ResolveReference(refs, name)
+		if err != nil {
+			return fmt.Errorf("resolve %s: %w", name, err)
+		}
+		if !head.Name().IsBranch() {
+			// The remote did not say which branch HEAD is
+			head = findBranch(refs, head.Hash())
+			if head == nil {
+				return errors.New("the remote HEAD is not a branch")
+			}
+		}
+
+		if commitHash.IsZero() {
+			commitHash = head.Hash()
+		} else if commitHash != head.Hash() && !ar.Capabilities.Supports(capability.AllowReachableSHA1InWant) {
+			return fmt.Errorf("the remote does not allow fetching commit %s", commitHash)
+		}
+
+		req.Wants = []plumbing.Hash{commitHash}
+		req.Depth = packp.DepthCommits(1)
+		req.Filter = packp.FilterBlobNone()
+		if err := req.Capabilities.Set(capability.Shallow); err != nil {
+			return err
+		}
+		return req.Capabilities.Set(capability.Filter)
+	}, s)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.SetShallow(shallows); err != nil {
+		return nil, err
+	}
+
+	if err := s.setupClone(plumbing.NewHashReference(head.Name(), commitHash)); err != nil {
+		return nil, err
+	}
+
+	commit, err := object.GetCommit(s, commitHash)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.SetIndex(treeIndex(tree)); err != nil {
+		return nil, err
+	}
+
+	wt, err := NewTreeFS(s, tree, commit.Committer.When, osfs.New(worktreeDir, osfs.WithBoundOS()))
+	if err != nil {
+		return nil, err
+	}
+	return git.Open(s, wt)
+}
+
+// setupClone writes the references and remote config a clone of head has
+func (s *PartialStorage) setupClone(head *plumbing.Reference) error {
+	branch := head.Name().Short()
+	remoteRef := plumbing.NewRemoteReferenceName("origin", branch)
+
+	refs := []*plumbing.Reference{
+		plumbing.NewHashReference(head.Name(), head.Hash()),
+		plumbing.NewHashReference(remoteRef, head.Hash()),
+		plumbing.NewSymbolicReference(plumbing.HEAD, head.Name()),
+	}
+	for _, ref := range refs {
+		if err := s.SetReference(ref); err != nil {
+			return err
+		}
+	}
+
+	conf := config.NewConfig()
+	conf.Remotes["origin"] = &config.RemoteConfig{
+		Name:  "origin",
+		URLs:  []string{s.url},
+		Fetch: []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", head.Name(), remoteRef))},
+	}
+	conf.Branches[branch] = &config.Branch{
+		Name:   branch,
+		Remote: "origin",
+		Merge:  head.Name(),
+	}
+	// Let git know where the missing blobs come from if the repository
+	// is ever written out
+	conf.Raw.Section("remote").Subsection("origin").
+		SetOption("promisor", "true").
+		SetOption("partialclonefilter", string(packp.FilterBlobNone()))
+	return s.SetConfig(conf)
+}
+
+// Fetch updates the remote tracking references of repository, like the
+// clone it leaves out blobs
+func (s *PartialStorage) Fetch(repository *git.Repository) error {
+	remote, err := repository.Remote("origin")
+	if err != nil {
+		return err
+	}
+	specs := remote.Config().Fetch
+
+	shallows, err := s.Shallow()
+	if err != nil {
+		return err
+	}
+
+	var updates []*plumbing.Reference
+	_, _, err = s.uploadPack(func(ar *packp.AdvRefs, req *packp.UploadPackRequest) error {
+		refs, err := ar.AllReferences()
+		if err != nil {
+			return err
+		}
+
+		wanted := map[plumbing.Hash]bool{}
+		for _, ref := range refs {
+			if ref.Type() != plumbing.HashReference {
+				continue
+			}
+			for _, spec := range specs {
+				if !spec.Match(ref.Name()) {
+					continue
+				}
+				updates = append(updates, plumbing.NewHashReference(spec.Dst(ref.Name()), ref.Hash()))
+				if s.Storage.HasEncodedObject(ref.Hash()) != nil && !wanted[ref.Hash()] {
+					wanted[ref.Hash()] = true
+					req.Wants = append(req.Wants, ref.Hash())
+				}
+			}
+		}
+
+		haves := map[plumbing.Hash]bool{}
+		iter, err := s.IterReferences()
+		if err != nil {
+			return err
+		}
+		err = iter.ForEach(func(ref *plumbing.Reference) error {
+			if ref.Type() == plumbing.HashReference && !haves[ref.Hash()] {
+				haves[ref.Hash()] = true
+				req.Haves = append(req.Haves, ref.Hash())
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(shallows) > 0 {
+			req.Shallows = shallows
+			if err := req.Capabilities.Set(capability.Shallow); err != nil {
+				return err
+			}
+		}
+		if ar.Capabilities.Supports(capability.Filter) {
+			req.Filter = packp.FilterBlobNone()
+			return req.Capabilities.Set(capability.Filter)
+		}
+		return nil
+	}, s)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range updates {
+		if err := s.SetReference(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findBranch returns a branch of refs pointing at hash
+func findBranch(refs storer.ReferenceStorer, hash plumbing.Hash) *plumbing.Reference {
+	iter, err := refs.IterReferences()
+	if err != nil {
+		return nil
+	}
+	var found *plumbing.Reference
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name().IsBranch() && ref.Hash() == hash && (found == nil || ref.Name() < found.Name()) {
+			found = ref
+		}
+		return nil
+	})
+	return found
+}
+
+// treeIndex builds the index of a checkout of tree without reading blobs
+func treeIndex(tree *object.Tree) *index.Index {
+	idx := &index.Index{Version: 2}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err != nil {
+			break
+		}
+		if entry.Mode == filemode.Dir {
+			continue
+		}
+		idx.Entries = append(idx.Entries, &index.Entry{Name: name, Hash: entry.Hash, Mode: entry.Mode})
+	}
+	sort.Slice(idx.Entries, func(i, j int) bool {
+		return idx.Entries[i].Name < idx.Entries[j].Name
+	})
+	return idx
+}
+
+// stagePendingLocked adds the paths changed since the last commit to the
+// index. A worktree that was never checked out is not compared with the
+// index, that would read every blob and fetch them in a partial clone.
+func (m *Manager) stagePendingLocked(wt *git.Worktree) (int, error) {
+	m.loadIgnoreLocked()
+
+	idx, err := m.repository.Storer.Index()
+	if err != nil {
+		return 0, err
+	}
+	before := map[string]plumbing.Hash{}
+	for _, entry := range idx.Entries {
+		before[entry.Name] = entry.Hash
+	}
+
+	// Paths that are gone take everything below them out of the index,
+	// the rest is added file by file. The index is only written once.
+	var add []string
+	for _, change := range m.PendingChanges() {
+		p := change.Path
+		if entry, err := idx.Entry(p); err == nil && entry.Mode == filemode.Submodule {
+			continue // Recorded by stageGitlinksLocked
+		}
+		if m.skipLockedLocked(p) {
+			continue
+		}
+
+		info, err := wt.Filesystem.Lstat(p)
+		if os.IsNotExist(err) {
+			removeFromIndex(idx, p)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !info.IsDir() {
+			add = append(add, p)
+			continue
+		}
+
+		// A directory that was moved here, the files below it are
+		// already in memory
+		err = walkFiles(wt.Filesystem, p, func(p string) {
+			add = append(add, p)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, p := range add {
+		if _, tracked := before[p]; !tracked && m.isIgnoredLocked(p) {
+			log.Printf("Not committing ignored file %s", p)
+			continue
+		}
+		if m.skipLockedLocked(p) {
+			continue
+		}
+		if err := m.addToIndexLocked(wt.Filesystem, idx, p); err != nil {
+			return 0, err
+		}
+	}
+
+	changed := 0
+	for _, entry := range idx.Entries {
+		if hash, ok := before[entry.Name]; !ok || hash != entry.Hash {
+			changed++
+		}
+		delete(before, entry.Name)
+	}
+	changed += len(before) // Removed
+	if changed > 0 {
+		if err := m.repository.Storer.SetIndex(idx); err != nil {
+			return 0, err
+		}
+	}
+	return changed, nil
+}
+
+// isBelow reports whether p is inside the directory dir
+func isBelow(p, dir string) bool {
+	return dir == "" || len(p) > len(dir) && p[len(dir)] == '/' && p[:len(dir)] == dir
+}
+
+// walkFiles calls fn with every file below dir
+func walkFiles(fs interface {
+	ReadDir(string) ([]os.FileInfo, error)
+}, dir string, fn func(string)) error {
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		p := path.Join(dir, info.Name())
+		if info.IsDir() {
+			if err := walkFiles(fs, p, fn); err != nil {
+				return err
+			}
+		} else {
+			fn(p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/billziss-gh/golib/retry"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+var (
+	// PushRetrySleep is the delay before the first push retry
+	PushRetrySleep = time.Second * 2
+	// PushRetryMaxSleep caps the delay between push retries
+	PushRetryMaxSleep = time.Minute * 5
+)
+
+// outboundRef points at the commit waiting to be pushed, pushes go through
+// it so that commits made after it are not pushed along
+const outboundRef = plumbing.ReferenceName("refs/gittyfs/outbound")
+
+// maxAhead bounds the history walk when counting unpushed commits
+const maxAhead = 1000
+
+// queueHeadLocked queues everything up to HEAD for the next push
+func (m *Manager) queueHeadLocked() {
+	head, err := m.repository.Head()
+	if err != nil {
+		log.Printf("Unable to resolve HEAD: %v", err)
+		return
+	}
+	if head.Hash() != m.pushed {
+		m.queued = head.Hash()
+	}
+}
+
+// pushLocked pushes the queued commit to the remote branch
+func (m *Manager) pushLocked() error {
+	if m.queued.IsZero() || m.queued == m.pushed {
+		m.queued = plumbing.ZeroHash
+		return nil // Nothing new to push
+	}
+
+	head, err := m.repository.Head()
+	if err != nil {
+		return fmt.Errorf("failed to get head: %w", err)
+	}
+
+	err = m.repository.Storer.SetReference(plumbing.NewHashReference(outboundRef, m.queued))
+	if err != nil {
+		return fmt.Errorf("failed to set %s: %w", outboundRef, err)
+	}
+
+	// LFS objects have to be on the server before the pointers are
+	err = m.uploadLFS(context.Background())
+	if err != nil {
+		err = fmt.Errorf("push: %w", err)
+		m.recordPush(err)
+		return err
+	}
+
+	authMethod, err := m.auth()
+	if err == nil {
+		refSpec := config.RefSpec(fmt.Sprintf("%s:%s", outboundRef, head.Name()))
+		err = m.repository.Push(&git.PushOptions{
+			Auth:     authMethod,
+			RefSpecs: []config.RefSpec{refSpec},
+		})
+		if err == git.NoErrAlreadyUpToDate {
+			err = nil
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("push: %w", err)
+		m.recordPush(err)
+		return err
+	}
+
+	log.Printf("Pushed %s\n", m.queued)
+	m.pushed = m.queued
+	m.queued = plumbing.ZeroHash
+	m.updateAheadLocked()
+	m.recordPush(nil)
+	if m.onPush != nil {
+		m.onPush(m.pushed)
+	}
+	return nil
+}
+
+// requestPush makes the push loop retry the queued commit in the background
+func (m *Manager) requestPush() {
+	select {
+	case m.pushRequests <- struct{}{}:
+	default:
+		// A retry is already scheduled
+	}
+}
+
+// pushLoop retries failed pushes with exponential backoff until they succeed,
+// so that commits made while offline reach the remote once it is reachable
+func (m *Manager) pushLoop() {
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-m.pushRequests:
+		}
+
+		retry.Retry(
+			retry.Backoff(PushRetrySleep, PushRetryMaxSleep),
+			func(i int) bool {
+				if i == 0 {
+					// The caller already made the first attempt
+					return true
+				}
+
+				m.mu.Lock()
+				defer m.mu.Unlock()
+
+				// Stop does not wait for the backoff, a retry that wakes up
+				// after it leaves the repository alone
+				select {
+				case <-m.done:
+					return false
+				default:
+				}
+
+				err := m.pushLocked()
+				if err == nil {
+					return false
+				}
+
+				// Retrying will not help when the remote moved on
+				if errors.Is(err, git.ErrNonFastForwardUpdate) {
+					log.Printf("Giving up on push, remote has diverged: %v\n", err)
+					return false
+				}
+
+				log.Printf("Push retry %d failed: %v\n", i, err)
+				return true
+			})
+	}
+}
+
+// updateAheadLocked recounts the commits on HEAD that are not on the remote
+func (m *Manager) updateAheadLocked() {
+	head, err := m.repository.Head()
+	if err != nil {
+		return
+	}
+
+	ahead := 0
+	hash := head.Hash()
+	for hash != m.pushed && ahead < maxAhead {
+		commit, err := m.repository.CommitObject(hash)
+		if err != nil || len(commit.ParentHashes) == 0 {
+			break
+		}
+		ahead++
+		hash = commit.ParentHashes[0]
+	}
+
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.state.ahead = ahead
+}
@@ -0,0 +1,243 @@
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// quarantineRefPrefix is where commits holding secrets are kept, they never
+// leave the local repository
+const quarantineRefPrefix = "refs/gittyfs/quarantine/"
+
+// maxScanSize is the largest blob scanned for secrets, bigger blobs are
+// assumed not to be configuration or source files
+const maxScanSize = 10 << 20
+
+// secretRule is a single pattern the scanner looks for
+type secretRule struct {
+	name    string
+	pattern *regexp.Regexp
+	// entropy, when set, is the minimum Shannon entropy in bits per
+	// character of the first capture group for the rule to match
+	entropy float64
+}
+
+var defaultSecretRules = []secretRule{
+	{name: "private key", pattern: regexp.MustCompile(`-----BEGIN[ A-Z0-9_-]*PRIVATE KEY( BLOCK)?-----`)},
+	{name: "AWS access key", pattern: regexp.MustCompile(`\b(?:AKIA|ASIA|AGPA|AIDA|AROA|ANPA|ANVA)[0-9A-Z]{16}\b`)},
+	{name: "AWS secret key", pattern: regexp.MustCompile(`(?i)aws.{0,20}?secret.{0,20}?['"]?\s*[:=]\s*['"]?([A-Za-z0-9/+=]{40})\b`)},
+	{name: "GitHub token", pattern: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b`)},
+	{name: "Slack token", pattern: regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{name: "Google API key", pattern: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{name: "Stripe key", pattern: regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}\b`)},
+	// Random strings only count next to a telling name, lock files and
+	// checksums are full of high entropy strings that are not secret
+	{
+		name:    "high entropy token",
+		pattern: regexp.MustCompile(`(?i)(?:api[_-]?key|access[_-]?key|auth|token|secret|passw(?:or)?d|credentials?)["']?\s*[:=]\s*["']?([A-Za-z0-9+/=_.~-]{20,})`),
+		entropy: 4,
+	},
+}
+
+// compileSecretRules adds the configured patterns to the built in ones
+func compileSecretRules(patterns []string) ([]secretRule, error) {
+	rules := append([]secretRule{}, defaultSecretRules...)
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("secret pattern %q: %w", p, err)
+		}
+		rules = append(rules, secretRule{name: p, pattern: re})
+	}
+	return rules, nil
+}
+
+// SecretFinding is a line that looks like it holds a secret
+type SecretFinding struct {
+	Path string `json:"path"`
+	Line int    `json:"line"`
+	Rule string `json:"rule"`
+}
+
+// SecretError is returned when a commit was quarantined because it adds
+// something that looks like a secret
+type SecretError struct {
+	Commit   plumbing.Hash
+	Findings []SecretFinding
+}
+
+func (e *SecretError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "possible secrets found, commit %s quarantined as %s%s:", e.Commit, quarantineRefPrefix, e.Commit)
+	for _, f := range e.Findings {
+		fmt.Fprintf(&b, "\n%s:%d: %s", f.Path, f.Line, f.Rule)
+	}
+	return b.String()
+}
+
+// quarantineLocked scans what the commit at HEAD adds, if anything matches
+// the commit is moved to a quarantine ref and the branch is put back on its
+// parent. The index is left alone so the changes are still staged.
+func (m *Manager) quarantineLocked(hash plumbing.Hash) error {
+	if len(m.secretRules) == 0 {
+		return nil
+	}
+
+	commit, err := m.repository.CommitObject(hash)
+	if err != nil {
+		return fmt.Errorf("failed to get commit: %w", err)
+	}
+
+	findings, err := m.scanCommit(commit)
+	if err != nil {
+		return fmt.Errorf("failed to scan for secrets: %w", err)
+	}
+	if len(findings) == 0 {
+		return nil
+	}
+
+	head, err := m.repository.Head()
+	if err != nil {
+		return fmt.Errorf("failed to get head: %w", err)
+	}
+
+	ref := plumbing.ReferenceName(quarantineRefPrefix + hash.String())
+	err = m.repository.Storer.SetReference(plumbing.NewHashReference(ref, hash))
+	if err != nil {
+		return fmt.Errorf("failed to set %s: %w", ref, err)
+	}
+
+	if len(commit.ParentHashes) > 0 {
+		parent := commit.ParentHashes[0]
+		err = m.repository.Storer.SetReference(plumbing.NewHashReference(head.Name(), parent))
+		if err != nil {
+			return fmt.Errorf("failed to reset %s: %w", head.Name(), err)
+		}
+		m.setHead(parent)
+	}
+
+	log.Printf("Quarantined %s, it adds possible secrets\n", hash)
+	m.addQuarantined(hash)
+	return &SecretError{Commit: hash, Findings: findings}
+}
+
+// scanCommit returns the lines a commit adds that match a secret rule
+func (m *Manager) scanCommit(commit *object.Commit) ([]SecretFinding, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	parentTree := &object.Tree{}
+	if len(commit.ParentHashes) > 0 {
+		parent, err := m.repository.CommitObject(commit.ParentHashes[0])
+		if err != nil {
+			return nil, err
+		}
+		if parentTree, err = parent.Tree(); err != nil {
+			return nil, err
+		}
+	}
+
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []SecretFinding
+	for _, change := range changes {
+		if change.To.TreeEntry.Mode == filemode.Submodule || change.From.TreeEntry.Mode == filemode.Submodule {
+			continue
+		}
+		from, to, err := change.Files()
+		if err != nil {
+			return nil, err
+		}
+		if to == nil || to.Size > maxScanSize {
+			continue
+		}
+		if binary, err := to.IsBinary(); err != nil || binary {
+			continue
+		}
+
+		// Only lines that are new count, secrets already on the remote
+		// should not block every later edit of the file
+		old := map[string]bool{}
+		if from != nil && from.Size <= maxScanSize {
+			content, err := from.Contents()
+			if err != nil {
+				return nil, err
+			}
+			for _, line := range strings.Split(content, "\n") {
+				old[line] = true
+			}
+		}
+
+		content, err := to.Contents()
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, scanContent(to.Name, []byte(content), old, m.secretRules)...)
+	}
+
+	return findings, nil
+}
+
+// scanContent matches every line of content not in skip against the rules
+func scanContent(path string, content []byte, skip map[string]bool, rules []secretRule) []SecretFinding {
+	var findings []SecretFinding
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, maxScanSize)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if skip[line] {
+			continue
+		}
+		for _, rule := range rules {
+			if rule.matches(line) {
+				findings = append(findings, SecretFinding{Path: path, Line: n, Rule: rule.name})
+				break
+			}
+		}
+	}
+
+	return findings
+}
+
+func (r secretRule) matches(line string) bool {
+	if r.entropy == 0 {
+		return r.pattern.MatchString(line)
+	}
+	for _, match := range r.pattern.FindAllStringSubmatch(line, -1) {
+		if len(match) > 1 && shannonEntropy(match[1]) >= r.entropy {
+			return true
+		}
+	}
+	return false
+}
+
+// shannonEntropy returns the entropy of s in bits per character
+func shannonEntropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, c := range s {
+		counts[c]++
+	}
+
+	var entropy float64
+	n := float64(len(s))
+	for _, count := range counts {
+		p := float64(count) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
@@ -0,0 +1,303 @@
+package manager
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SigningFormat is the kind of key commits are signed with, named after the
+// values of the gpg.format git config
+type SigningFormat string
+
+const (
+	SigningFormatOpenPGP SigningFormat = "openpgp"
+	SigningFormatSSH     SigningFormat = "ssh"
+)
+
+// ParseSigningFormat parses a signing format, the empty string is openpgp
+// like it is for git
+func ParseSigningFormat(s string) (SigningFormat, error) {
+	switch format := SigningFormat(s); format {
+	case "":
+		return SigningFormatOpenPGP, nil
+	case SigningFormatOpenPGP, SigningFormatSSH:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported signing format %q", s)
+	}
+}
+
+// signerLocked returns the signer for new commits, nil when commits are not
+// signed. The key is loaded on first use so that a broken key shows up as a
+// sync error instead of silently producing unsigned commits.
+func (m *Manager) signerLocked() (git.Signer, error) {
+	if m.signer != nil || m.signingKey == "" {
+		return m.signer, nil
+	}
+
+	format, err := ParseSigningFormat(string(m.signingFormat))
+	if err != nil {
+		return nil, err
+	}
+
+	var signer git.Signer
+	switch format {
+	case SigningFormatOpenPGP:
+		signer, err = loadOpenPGPSigner(m.signingKey)
+	case SigningFormatSSH:
+		signer, err = loadSSHSigner(m.signingKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signing key %s: %w", m.signingKey, err)
+	}
+
+	m.signer = signer
+	return signer, nil
+}
+
+// signCommit adds a signature to a commit built by hand
+func signCommit(signer git.Signer, commit *object.Commit) error {
+	encoded := &plumbing.MemoryObject{}
+	if err := commit.EncodeWithoutSignature(encoded); err != nil {
+		return err
+	}
+	r, err := encoded.Reader()
+	if err != nil {
+		return err
+	}
+
+	sig, err := signer.Sign(r)
+	if err != nil {
+		return err
+	}
+	commit.PGPSignature = string(sig)
+	return nil
+}
+
+// signingConfig looks up user.signingkey and gpg.format in the repository
+// config, falling back to the global git config
+func signingConfig(repository *git.Repository) (key string, format SigningFormat) {
+	lookup := func(conf *config.Config) {
+		if conf == nil || conf.Raw == nil {
+			return
+		}
+		if key == "" {
+			key = conf.Raw.Section("user").Option("signingkey")
+		}
+		if format == "" {
+			format = SigningFormat(conf.Raw.Section("gpg").Option("format"))
+		}
+	}
+
+	if conf, err := repository.Config(); err == nil {
+		lookup(conf)
+	}
+	if conf, err := config.LoadConfig(config.GlobalScope); err == nil {
+		lookup(conf)
+	}
+
+	return key, format
+}
+
+// identityConfig looks up user.name and user.email in the repository config,
+// falling back to the global git config and then to the gittyfs identity
+func identityConfig(repository *git.Repository) (name, email string) {
+	lookup := func(conf *config.Config) {
+		if conf == nil || conf.Raw == nil {
+			return
+		}
+		if name == "" {
+			name = conf.Raw.Section("user").Option("name")
+		}
+		if email == "" {
+			email = conf.Raw.Section("user").Option("email")
+		}
+	}
+
+	if conf, err := repository.Config(); err == nil {
+		lookup(conf)
+	}
+	if conf, err := config.LoadConfig(config.GlobalScope); err == nil {
+		lookup(conf)
+	}
+
+	if name == "" {
+		name = defaultAuthorName
+	}
+	if email == "" {
+		email = defaultAuthorEmail
+	}
+	return name, email
+}
+
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
+
+// openpgpSigner produces armored detached OpenPGP signatures
+type openpgpSigner struct {
+	entity *openpgp.Entity
+}
+
+func (s *openpgpSigner) Sign(message io.Reader) ([]byte, error) {
+	var b bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&b, s.entity, message, nil); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// loadOpenPGPSigner reads an armored private key, gpg keyring ids are not
+// supported as there is no gpg-agent to ask
+func loadOpenPGPSigner(path string) (git.Signer, error) {
+	f, err := os.Open(expandHome(path))
+	if err != nil {
+		return nil, fmt.Errorf("openpgp signing needs the path of an armored private key: %w", err)
+	}
+	defer f.Close()
+
+	entities, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entity := range entities {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if entity.PrivateKey.Encrypted {
+			return nil, errors.New("encrypted private keys are not supported")
+		}
+		return &openpgpSigner{entity: entity}, nil
+	}
+
+	return nil, errors.New("no private key found")
+}
+
+// sshSigner produces SSH signatures as described in OpenSSH's PROTOCOL.sshsig,
+// which is what git creates with gpg.format=ssh
+type sshSigner struct {
+	signer ssh.Signer
+}
+
+const (
+	sshsigMagic     = "SSHSIG"
+	sshsigVersion   = 1
+	sshsigNamespace = "git"
+	sshsigHash      = "sha512"
+)
+
+func (s *sshSigner) Sign(message io.Reader) ([]byte, error) {
+	h := sha512.New()
+	if _, err := io.Copy(h, message); err != nil {
+		return nil, err
+	}
+
+	signedData := struct {
+		Namespace string
+		Reserved  string
+		Hash      string
+		Digest    []byte
+	}{sshsigNamespace, "", sshsigHash, h.Sum(nil)}
+	toSign := append([]byte(sshsigMagic), ssh.Marshal(signedData)...)
+
+	var sig *ssh.Signature
+	var err error
+	if as, ok := s.signer.(ssh.AlgorithmSigner); ok && s.signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// The SHA-1 based ssh-rsa algorithm is not accepted for sshsig
+		sig, err = as.SignWithAlgorithm(nil, toSign, ssh.KeyAlgoRSASHA512)
+	} else {
+		sig, err = s.signer.Sign(nil, toSign)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	blob := struct {
+		Version   uint32
+		PublicKey []byte
+		Namespace string
+		Reserved  string
+		Hash      string
+		Signature []byte
+	}{sshsigVersion, s.signer.PublicKey().Marshal(), sshsigNamespace, "", sshsigHash, ssh.Marshal(sig)}
+	data := append([]byte(sshsigMagic), ssh.Marshal(blob)...)
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var b bytes.Buffer
+	b.WriteString("-----BEGIN SSH SIGNATURE-----\n")
+	for len(encoded) > 70 {
+		b.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	b.WriteString(encoded + "\n")
+	b.WriteString("-----END SSH SIGNATURE-----\n")
+	return b.Bytes(), nil
+}
+
+// loadSSHSigner loads an SSH signing key. Like git the key may be given as a
+// private key file, or as a public key (a .pub file or a literal "key::"
+// value) whose private half is held by the ssh-agent.
+func loadSSHSigner(key string) (git.Signer, error) {
+	var pubData []byte
+	if strings.HasPrefix(key, "key::") {
+		pubData = []byte(strings.TrimPrefix(key, "key::"))
+	} else if strings.HasPrefix(key, "ssh-") || strings.HasPrefix(key, "ecdsa-") {
+		pubData = []byte(key)
+	} else {
+		data, err := os.ReadFile(expandHome(key))
+		if err != nil {
+			return nil, err
+		}
+		if signer, err := ssh.ParsePrivateKey(data); err == nil {
+			return &sshSigner{signer: signer}, nil
+		} else if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			return nil, errors.New("encrypted private keys are not supported, load the key into ssh-agent and configure its public key")
+		}
+		pubData = data
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pubData)
+	if err != nil {
+		return nil, fmt.Errorf("parse public key: %w", err)
+	}
+
+	conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	if err != nil {
+		return nil, fmt.Errorf("connect to ssh-agent: %w", err)
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("list ssh-agent keys: %w", err)
+	}
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), pub.Marshal()) {
+			return &sshSigner{signer: signer}, nil
+		}
+	}
+	conn.Close()
+
+	return nil, errors.New("key not found in ssh-agent")
+}
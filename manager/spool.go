@@ -0,0 +1,103 @@
+package manager
+
+import (
+	"io"
+	"os"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// spoolObject is an object that keeps its content in memory until it grows
+// past threshold and in an unlinked file in dir from then on, so that a large
+// file can be staged without holding it in memory. The file is closed once
+// the object is dropped.
+type spoolObject struct {
+	*plumbing.MemoryObject
+	dir       string
+	threshold int64
+
+	file *os.File
+	size int64
+	hash plumbing.Hash
+}
+
+func newSpoolObject(dir string, threshold int64) *spoolObject {
+	return &spoolObject{MemoryObject: &plumbing.MemoryObject{}, dir: dir, threshold: threshold}
+}
+
+func (o *spoolObject) Size() int64 {
+	if o.file == nil {
+		return o.MemoryObject.Size()
+	}
+	return o.size
+}
+
+func (o *spoolObject) Hash() plumbing.Hash {
+	if o.file == nil {
+		return o.MemoryObject.Hash()
+	}
+	if o.hash != plumbing.ZeroHash {
+		return o.hash
+	}
+
+	h := plumbing.NewHasher(o.Type(), o.size)
+	if _, err := io.Copy(h, io.NewSectionReader(o.file, 0, o.size)); err != nil {
+		return plumbing.ZeroHash
+	}
+	o.hash = h.Sum()
+	return o.hash
+}
+
+func (o *spoolObject) Reader() (io.ReadCloser, error) {
+	if o.file == nil {
+		return o.MemoryObject.Reader()
+	}
+	return io.NopCloser(io.NewSectionReader(o.file, 0, o.size)), nil
+}
+
+func (o *spoolObject) Writer() (io.WriteCloser, error) {
+	return o, nil
+}
+
+func (o *spoolObject) Write(p []byte) (int, error) {
+	if o.file == nil && o.MemoryObject.Size()+int64(len(p)) > o.threshold {
+		if err := o.spill(); err != nil {
+			return 0, err
+		}
+	}
+	if o.file == nil {
+		return o.MemoryObject.Write(p)
+	}
+
+	n, err := o.file.WriteAt(p, o.size)
+	o.size += int64(n)
+	o.hash = plumbing.ZeroHash
+	return n, err
+}
+
+// spill moves the content written so far to the file
+func (o *spoolObject) spill() error {
+	file, err := os.CreateTemp(o.dir, "gittyfs-object-")
+	if err != nil {
+		return err
+	}
+	// Nothing else needs the name, the file goes away once it is closed
+	os.Remove(file.Name())
+
+	r, _ := o.MemoryObject.Reader()
+	n, err := io.Copy(file, r)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	o.file = file
+	o.size = n
+	empty := &plumbing.MemoryObject{}
+	empty.SetType(o.Type())
+	o.MemoryObject = empty
+	return nil
+}
+
+func (o *spoolObject) Close() error {
+	return nil
+}
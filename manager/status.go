@@ -0,0 +1,266 @@
+package manager
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// state holds everything the manager reports about itself, it is guarded by
+// Manager.stateMu
+type state struct {
+	head      plumbing.Hash
+	branch    string
+	pending   map[string]ChangeNotification
+	paused    bool
+	message   string
+	lastSync  time.Time
+	syncErr   error
+	lastFetch time.Time
+	fetchErr  error
+	ahead     int
+	lastPush  time.Time
+	pushErr   error
+
+	quarantined []plumbing.Hash
+}
+
+// Status is a snapshot of the manager state
+type Status struct {
+	Head           string               `json:"head"`
+	Branch         string               `json:"branch"`
+	Paused         bool                 `json:"paused"`
+	ReadOnly       bool                 `json:"read_only,omitempty"`
+	CommitMode     CommitMode           `json:"commit_mode"`
+	CommitMessage  string               `json:"commit_message,omitempty"`
+	PendingChanges []ChangeNotification `json:"pending_changes"`
+	LastSync       *time.Time           `json:"last_sync,omitempty"`
+	LastSyncError  string               `json:"last_sync_error,omitempty"`
+	LastFetch      *time.Time           `json:"last_fetch,omitempty"`
+	LastFetchError string               `json:"last_fetch_error,omitempty"`
+
+	// Ahead is the number of local commits the remote does not have yet
+	Ahead         int        `json:"ahead"`
+	LastPush      *time.Time `json:"last_push,omitempty"`
+	LastPushError string     `json:"last_push_error,omitempty"`
+
+	// Quarantined lists commits that were held back because they add
+	// possible secrets
+	Quarantined []string `json:"quarantined,omitempty"`
+}
+
+// Status returns a snapshot of the current manager state
+func (m *Manager) Status() Status {
+	m.stateMu.RLock()
+	defer m.stateMu.RUnlock()
+
+	status := Status{
+		Branch:         m.state.branch,
+		Paused:         m.state.paused,
+		ReadOnly:       m.options.ReadOnly,
+		CommitMode:     m.commitMode,
+		CommitMessage:  m.state.message,
+		PendingChanges: m.pendingLocked(),
+	}
+	if !m.state.head.IsZero() {
+		status.Head = m.state.head.String()
+	}
+	if !m.state.lastSync.IsZero() {
+		t := m.state.lastSync
+		status.LastSync = &t
+	}
+	if m.state.syncErr != nil {
+		status.LastSyncError = m.state.syncErr.Error()
+	}
+	if !m.state.lastFetch.IsZero() {
+		t := m.state.lastFetch
+		status.LastFetch = &t
+	}
+	if m.state.fetchErr != nil {
+		status.LastFetchError = m.state.fetchErr.Error()
+	}
+	status.Ahead = m.state.ahead
+	if !m.state.lastPush.IsZero() {
+		t := m.state.lastPush
+		status.LastPush = &t
+	}
+	if m.state.pushErr != nil {
+		status.LastPushError = m.state.pushErr.Error()
+	}
+	for _, hash := range m.state.quarantined {
+		status.Quarantined = append(status.Quarantined, hash.String())
+	}
+
+	return status
+}
+
+// Head returns the commit the manager last saw HEAD pointing at
+func (m *Manager) Head() plumbing.Hash {
+	m.stateMu.RLock()
+	defer m.stateMu.RUnlock()
+	return m.state.head
+}
+
+// PendingChanges returns the changes that have not been synced yet, ordered
+// by path
+func (m *Manager) PendingChanges() []ChangeNotification {
+	m.stateMu.RLock()
+	defer m.stateMu.RUnlock()
+	return m.pendingLocked()
+}
+
+// Pause stops the automatic sync, changes are still collected
+func (m *Manager) Pause() {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.state.paused = true
+}
+
+// Resume re-enables the automatic sync
+func (m *Manager) Resume() {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.state.paused = false
+}
+
+// Paused reports whether the automatic sync is paused
+func (m *Manager) Paused() bool {
+	m.stateMu.RLock()
+	defer m.stateMu.RUnlock()
+	return m.state.paused
+}
+
+// SetCommitMessage sets the message used for the next commit, an empty
+// message restores the default
+func (m *Manager) SetCommitMessage(message string) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.state.message = strings.TrimSpace(message)
+}
+
+// CommitMessage returns the message that will be used for the next commit,
+// empty if the default will be used
+func (m *Manager) CommitMessage() string {
+	m.stateMu.RLock()
+	defer m.stateMu.RUnlock()
+	return m.state.message
+}
+
+// consumeCommitMessage clears the commit message once it has been used,
+// unless it was replaced in the meantime
+func (m *Manager) consumeCommitMessage(message string) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	if m.state.message == message {
+		m.state.message = ""
+	}
+}
+
+func (m *Manager) pendingLocked() []ChangeNotification {
+	pending := make([]ChangeNotification, 0, len(m.state.pending))
+	for _, change := range m.state.pending {
+		pending = append(pending, change)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Path < pending[j].Path
+	})
+	return pending
+}
+
+func (m *Manager) addPending(change ChangeNotification) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.state.pending[change.Path] = change
+}
+
+func (m *Manager) clearPending() {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.state.pending = map[string]ChangeNotification{}
+}
+
+func (m *Manager) setHead(head plumbing.Hash) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.state.head = head
+}
+
+func (m *Manager) addQuarantined(hash plumbing.Hash) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.state.quarantined = append(m.state.quarantined, hash)
+}
+
+func (m *Manager) recordSync(err error) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.state.lastSync = time.Now()
+	m.state.syncErr = err
+}
+
+func (m *Manager) recordPush(err error) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.state.lastPush = time.Now()
+	m.state.pushErr = err
+}
+
+func (m *Manager) recordFetch(err error) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.state.lastFetch = time.Now()
+	m.state.fetchErr = err
+}
+
+// LogEntry describes a single commit of the mounted branch
+type LogEntry struct {
+	Hash    string    `json:"hash"`
+	Author  string    `json:"author"`
+	Date    time.Time `json:"date"`
+	Message string    `json:"message"`
+}
+
+// Log returns up to n commits reachable from HEAD, newest first
+func (m *Manager) Log(n int) ([]LogEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	head, err := m.repository.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get head: %w", err)
+	}
+
+	iter, err := m.repository.Log(&git.LogOptions{From: head.Hash()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get log: %w", err)
+	}
+	defer iter.Close()
+
+	entries := []LogEntry{}
+	for len(entries) < n {
+		commit, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Shallow clones end in a commit whose parents are missing
+			if err == plumbing.ErrObjectNotFound {
+				break
+			}
+			return nil, fmt.Errorf("failed to walk log: %w", err)
+		}
+		entries = append(entries, LogEntry{
+			Hash:    commit.Hash.String(),
+			Author:  fmt.Sprintf("%s <%s>", commit.Author.Name, commit.Author.Email),
+			Date:    commit.Author.When,
+			Message: strings.TrimSpace(commit.Message),
+		})
+	}
+
+	return entries, nil
+}
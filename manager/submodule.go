@@ -0,0 +1,198 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// SubmodulePaths returns the paths of the submodules recorded in the index
+func (m *Manager) SubmodulePaths() map[string]bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	paths := map[string]bool{}
+	idx, err := m.repository.Storer.Index()
+	if err != nil {
+		log.Printf("Error reading index: %v", err)
+		return paths
+	}
+	for _, entry := range idx.Entries {
+		if entry.Mode == filemode.Submodule {
+			paths[entry.Name] = true
+		}
+	}
+	return paths
+}
+
+// OpenSubmodule clones the submodule at p at the commit recorded for it and
+// starts a manager for it. Every commit the submodule manager pushes is
+// recorded as the new gitlink of p and committed in this repository.
+func (m *Manager) OpenSubmodule(p string) (*Manager, *git.Repository, error) {
+	m.mu.Lock()
+	url, branch, commit, err := m.submoduleLocked(p)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, nil, fmt.Errorf("submodule %s: %w", p, err)
+	}
+
+	log.Printf("Cloning submodule %s from %s", p, url)
+
+	var auth transport.AuthMethod
+	if ep, err := transport.NewEndpoint(url); err == nil && ep.Protocol == "ssh" {
+		if auth, err = m.auth(); err != nil {
+			return nil, nil, fmt.Errorf("submodule %s: %w", p, err)
+		}
+	}
+
+	// Submodules are cloned like this repository was, next to it
+	dir, err := os.MkdirTemp(m.options.Dir, "gittyfs-submodule-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("submodule %s: %w", p, err)
+	}
+	var repository *git.Repository
+	if m.partial != nil {
+		repository, err = clonePartialCommit(url, branch, commit, auth, m.partial.maxCache, dir, m.partial.spoolSize)
+	} else {
+		repository, err = cloneCommit(url, branch, commit, auth, dir, m.largeObject())
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, fmt.Errorf("submodule %s: clone %s: %w", p, url, err)
+	}
+
+	subOptions := m.options
+	subOptions.PreCommit = nil
+	subOptions.LFSURL = ""
+	subOptions.PushBranch = ""
+	subOptions.Dir = dir
+	subOptions.OnPush = func(hash plumbing.Hash) {
+		m.recordGitlink(p, hash)
+	}
+
+	sub, err := NewManager(repository, m.authFile, subOptions)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, fmt.Errorf("submodule %s: %w", p, err)
+	}
+
+	m.subMu.Lock()
+	m.submodules[p] = sub
+	m.subMu.Unlock()
+
+	go sub.Run()
+	return sub, repository, nil
+}
+
+// submoduleLocked looks up the url, branch and recorded commit of the
+// submodule at p
+func (m *Manager) submoduleLocked(p string) (url, branch string, commit plumbing.Hash, err error) {
+	idx, err := m.repository.Storer.Index()
+	if err != nil {
+		return "", "", plumbing.ZeroHash, err
+	}
+	entry, err := idx.Entry(p)
+	if err != nil || entry.Mode != filemode.Submodule {
+		return "", "", plumbing.ZeroHash, errors.New("not a submodule")
+	}
+
+	wt, err := m.repository.Worktree()
+	if err != nil {
+		return "", "", plumbing.ZeroHash, err
+	}
+	submodules, err := wt.Submodules()
+	if err != nil {
+		return "", "", plumbing.ZeroHash, fmt.Errorf("read .gitmodules: %w", err)
+	}
+	for _, submodule := range submodules {
+		conf := submodule.Config()
+		if conf.Path != p {
+			continue
+		}
+		url, err := m.resolveSubmoduleURL(conf.URL)
+		return url, conf.Branch, entry.Hash, err
+	}
+
+	return "", "", plumbing.ZeroHash, errors.New("missing from .gitmodules")
+}
+
+// resolveSubmoduleURL resolves urls relative to the origin remote like git
+// does
+func (m *Manager) resolveSubmoduleURL(url string) (string, error) {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url, nil
+	}
+
+	remote, err := m.repository.Remote("origin")
+	if err != nil || len(remote.Config().URLs) == 0 {
+		return "", fmt.Errorf("relative url %s without an origin remote", url)
+	}
+	ep, err := transport.NewEndpoint(remote.Config().URLs[0])
+	if err != nil {
+		return "", err
+	}
+	ep.Path = path.Join(ep.Path, url)
+	return ep.String(), nil
+}
+
+// recordGitlink queues a new commit of the submodule at p to be committed
+func (m *Manager) recordGitlink(p string, hash plumbing.Hash) {
+	m.subMu.Lock()
+	m.gitlinks[p] = hash
+	m.subMu.Unlock()
+
+	m.NotifyChange(p, "submodule")
+}
+
+// stageGitlinksLocked writes the queued submodule commits to the index
+func (m *Manager) stageGitlinksLocked() error {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+
+	if len(m.gitlinks) == 0 {
+		return nil
+	}
+
+	idx, err := m.repository.Storer.Index()
+	if err != nil {
+		return err
+	}
+	for p, hash := range m.gitlinks {
+		entry, err := idx.Entry(p)
+		if err != nil {
+			log.Printf("Submodule %s is gone, not recording %s", p, hash)
+			continue
+		}
+		entry.Hash = hash
+	}
+	if err := m.repository.Storer.SetIndex(idx); err != nil {
+		return err
+	}
+
+	m.gitlinks = map[string]plumbing.Hash{}
+	return nil
+}
+
+// stopSubmodules stops the managers of the opened submodules
+func (m *Manager) stopSubmodules() {
+	m.subMu.Lock()
+	submodules := m.submodules
+	m.submodules = map[string]*Manager{}
+	m.subMu.Unlock()
+
+	for _, sub := range submodules {
+		sub.Stop()
+		// Without a directory of our own nobody else removes the clone
+		if m.options.Dir == "" {
+			os.RemoveAll(sub.options.Dir)
+		}
+	}
+}
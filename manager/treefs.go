@@ -0,0 +1,574 @@
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// UnfetchedBlob is the Sys of the file info of a file whose blob was not
+// fetched yet, its size is reported as zero until it is
+type UnfetchedBlob struct {
+	Hash plumbing.Hash
+}
+
+// BlobStorage is where a TreeFS reads blobs from
+type BlobStorage interface {
+	EncodedObject(plumbing.ObjectType, plumbing.Hash) (plumbing.EncodedObject, error)
+
+	// BlobSize returns the size of a blob if it is known without
+	// fetching it
+	BlobSize(plumbing.Hash) (int64, bool)
+}
+
+// TreeFS is the worktree of a clone that was not checked out. It lists the
+// tree of the cloned commit without reading any blob, files are read from
+// the storage when opened. Files that are written are copied to the upper
+// filesystem layered on top of the tree, removed ones are hidden.
+type TreeFS struct {
+	storage BlobStorage
+	modTime time.Time
+
+	// spoolDir, when set, holds the content of blobs larger than spoolSize
+	// so that they can be read at any offset without being held in memory
+	spoolDir  string
+	spoolSize int64
+
+	mu      sync.Mutex
+	upper   billy.Filesystem
+	files   map[string]object.TreeEntry
+	dirs    map[string][]string
+	removed map[string]bool
+}
+
+var _ billy.Filesystem = (*TreeFS)(nil)
+
+// NewTreeFS creates the worktree of tree with written files kept in upper,
+// modTime is reported for every file that was not changed
+func NewTreeFS(storage BlobStorage, tree *object.Tree, modTime time.Time, upper billy.Filesystem) (*TreeFS, error) {
+	fs := &TreeFS{
+		storage: storage,
+		modTime: modTime,
+		upper:   upper,
+		files:   map[string]object.TreeEntry{},
+		dirs:    map[string][]string{"": nil},
+		removed: map[string]bool{},
+	}
+
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		parent := path.Dir(name)
+		if parent == "." {
+			parent = ""
+		}
+		fs.dirs[parent] = append(fs.dirs[parent], entry.Name)
+
+		// Submodules are checked out as empty directories
+		if entry.Mode == filemode.Dir || entry.Mode == filemode.Submodule {
+			if _, ok := fs.dirs[name]; !ok {
+				fs.dirs[name] = nil
+			}
+		} else {
+			fs.files[name] = entry
+		}
+	}
+
+	return fs, nil
+}
+
+// cleanPath turns p into the slash separated form the tree uses, the root
+// is the empty string
+func cleanPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+}
+
+func notExist(op, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+}
+
+// inUpperLocked reports whether p was written and lives in the upper
+// filesystem
+func (fs *TreeFS) inUpperLocked(p string) bool {
+	_, err := fs.upper.Lstat(p)
+	return err == nil
+}
+
+// lowerStatLocked returns the file info of p in the tree
+func (fs *TreeFS) lowerStatLocked(p string) (os.FileInfo, error) {
+	if fs.removed[p] {
+		return nil, notExist("stat", p)
+	}
+	if _, ok := fs.dirs[p]; ok {
+		return &treeFileInfo{name: path.Base("/" + p), mode: os.ModeDir | 0755, modTime: fs.modTime}, nil
+	}
+	entry, ok := fs.files[p]
+	if !ok {
+		return nil, notExist("stat", p)
+	}
+
+	mode, err := entry.Mode.ToOSFileMode()
+	if err != nil {
+		return nil, err
+	}
+	info := &treeFileInfo{name: entry.Name, mode: mode, modTime: fs.modTime}
+	if size, ok := fs.storage.BlobSize(entry.Hash); ok {
+		info.size = size
+	} else {
+		info.sys = UnfetchedBlob{Hash: entry.Hash}
+	}
+	return info, nil
+}
+
+// lowerFileLocked returns the tree entry of p if it is a file that has not
+// been written
+func (fs *TreeFS) lowerFileLocked(p string) (object.TreeEntry, bool) {
+	if fs.removed[p] || fs.inUpperLocked(p) {
+		return object.TreeEntry{}, false
+	}
+	entry, ok := fs.files[p]
+	return entry, ok
+}
+
+// readBlob returns the content of a blob, fetching it if needed
+func (fs *TreeFS) readBlob(hash plumbing.Hash) ([]byte, error) {
+	obj, err := fs.storage.EncodedObject(plumbing.BlobObject, hash)
+	if err != nil {
+		return nil, err
+	}
+	return readObject(obj)
+}
+
+// readObject returns the content of an object
+func readObject(obj plumbing.EncodedObject) ([]byte, error) {
+	r, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// copyUp moves the file p from the tree to the upper filesystem so that it
+// can be changed, its content is only fetched when it is kept and copied
+// without holding it in memory
+func (fs *TreeFS) copyUp(p string, truncate bool) error {
+	fs.mu.Lock()
+	entry, ok := fs.lowerFileLocked(p)
+	fs.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var obj plumbing.EncodedObject
+	if !truncate || entry.Mode == filemode.Symlink {
+		var err error
+		if obj, err = fs.storage.EncodedObject(plumbing.BlobObject, entry.Hash); err != nil {
+			return err
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.inUpperLocked(p) {
+		return nil
+	}
+
+	var err error
+	if entry.Mode == filemode.Symlink {
+		var target []byte
+		if target, err = readObject(obj); err == nil {
+			err = fs.upper.Symlink(string(target), p)
+		}
+	} else {
+		err = fs.copyUpFileLocked(p, entry, obj)
+	}
+	if err != nil {
+		return err
+	}
+	fs.removed[p] = true
+	return nil
+}
+
+// copyUpFileLocked writes the content of obj, or nothing when it is nil, to
+// p in the upper filesystem
+func (fs *TreeFS) copyUpFileLocked(p string, entry object.TreeEntry, obj plumbing.EncodedObject) error {
+	mode, _ := entry.Mode.ToOSFileMode()
+	f, err := fs.upper.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if obj != nil {
+		var r io.ReadCloser
+		if r, err = obj.Reader(); err == nil {
+			_, err = io.Copy(f, r)
+			r.Close()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fs.upper.Remove(p)
+	}
+	return err
+}
+
+// lowerBelowLocked returns the paths of the tree below the directory p,
+// parents before their children
+func (fs *TreeFS) lowerBelowLocked(p string) []string {
+	var paths []string
+	for _, name := range fs.dirs[p] {
+		child := path.Join(p, name)
+		if fs.removed[child] {
+			continue
+		}
+		paths = append(paths, child)
+		if _, ok := fs.dirs[child]; ok {
+			paths = append(paths, fs.lowerBelowLocked(child)...)
+		}
+	}
+	return paths
+}
+
+func (fs *TreeFS) Create(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *TreeFS) Open(filename string) (billy.File, error) {
+	p := cleanPath(filename)
+
+	fs.mu.Lock()
+	if fs.inUpperLocked(p) {
+		defer fs.mu.Unlock()
+		return fs.upper.Open(p)
+	}
+	entry, ok := fs.lowerFileLocked(p)
+	fs.mu.Unlock()
+	if !ok {
+		if _, err := fs.Stat(p); err == nil {
+			return nil, &os.PathError{Op: "open", Path: p, Err: errors.New("is a directory")}
+		}
+		return nil, notExist("open", p)
+	}
+
+	obj, err := fs.storage.EncodedObject(plumbing.BlobObject, entry.Hash)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	if fs.spoolDir != "" && obj.Size() > fs.spoolSize {
+		f, err := fs.spool(obj)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: p, Err: err}
+		}
+		return &blobFile{name: filename, content: f, closer: f}, nil
+	}
+
+	content, err := readObject(obj)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return &blobFile{name: filename, content: bytes.NewReader(content)}, nil
+}
+
+// spool opens the copy of a large blob in spoolDir, making it first if there
+// is none. Copies are named after the blob, so two opens racing to make one
+// both end up with the same content.
+func (fs *TreeFS) spool(obj plumbing.EncodedObject) (*os.File, error) {
+	p := filepath.Join(fs.spoolDir, obj.Hash().String())
+	if f, err := os.Open(p); err == nil {
+		return f, nil
+	}
+
+	r, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp(fs.spoolDir, obj.Hash().String()+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (fs *TreeFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		return fs.Open(filename)
+	}
+
+	p := cleanPath(filename)
+	if err := fs.copyUp(p, flag&os.O_TRUNC != 0); err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.upper.OpenFile(p, flag, perm)
+}
+
+func (fs *TreeFS) Stat(filename string) (os.FileInfo, error) {
+	p := cleanPath(filename)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.inUpperLocked(p) {
+		return fs.upper.Stat(p)
+	}
+	return fs.lowerStatLocked(p)
+}
+
+func (fs *TreeFS) Lstat(filename string) (os.FileInfo, error) {
+	p := cleanPath(filename)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if info, err := fs.upper.Lstat(p); err == nil {
+		return info, nil
+	}
+	return fs.lowerStatLocked(p)
+}
+
+func (fs *TreeFS) Rename(oldpath, newpath string) error {
+	from, to := cleanPath(oldpath), cleanPath(newpath)
+
+	// Everything that moves has to be in the upper filesystem first
+	fs.mu.Lock()
+	moved := []string{from}
+	if _, ok := fs.dirs[from]; ok && !fs.removed[from] {
+		moved = append(moved, fs.lowerBelowLocked(from)...)
+	}
+	fs.mu.Unlock()
+
+	for _, p := range moved {
+		if err := fs.copyUp(p, false); err != nil {
+			return err
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, p := range moved {
+		if _, ok := fs.dirs[p]; ok && !fs.removed[p] {
+			if err := fs.upper.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+			fs.removed[p] = true
+		}
+	}
+
+	if err := fs.upper.MkdirAll(path.Dir("/"+to), 0755); err != nil {
+		return err
+	}
+	if err := fs.upper.Rename(from, to); err != nil {
+		return err
+	}
+	if _, ok := fs.files[to]; ok {
+		fs.removed[to] = true // Replaced
+	}
+	return nil
+}
+
+func (fs *TreeFS) Remove(filename string) error {
+	p := cleanPath(filename)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	info, err := fs.lowerStatLocked(p)
+	inLower := err == nil
+	if inLower && info.IsDir() && len(fs.lowerBelowLocked(p)) > 0 {
+		return &os.PathError{Op: "remove", Path: p, Err: errors.New("directory not empty")}
+	}
+
+	if fs.inUpperLocked(p) {
+		if err := fs.upper.Remove(p); err != nil {
+			return err
+		}
+	} else if !inLower {
+		return notExist("remove", p)
+	}
+
+	if inLower {
+		fs.removed[p] = true
+	}
+	return nil
+}
+
+func (fs *TreeFS) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+func (fs *TreeFS) TempFile(dir, prefix string) (billy.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.upper.TempFile(dir, prefix)
+}
+
+func (fs *TreeFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	p := cleanPath(dirname)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	found := false
+	infos := map[string]os.FileInfo{}
+	if children, ok := fs.dirs[p]; ok && !fs.removed[p] {
+		found = true
+		for _, name := range children {
+			if info, err := fs.lowerStatLocked(path.Join(p, name)); err == nil {
+				infos[name] = info
+			}
+		}
+	}
+	if upper, err := fs.upper.ReadDir(p); err == nil {
+		found = true
+		for _, info := range upper {
+			infos[info.Name()] = info
+		}
+	}
+	if !found {
+		return nil, notExist("readdir", p)
+	}
+
+	result := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result, nil
+}
+
+func (fs *TreeFS) MkdirAll(filename string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.upper.MkdirAll(cleanPath(filename), perm)
+}
+
+func (fs *TreeFS) Symlink(target, link string) error {
+	p := cleanPath(link)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, err := fs.lowerStatLocked(p); err == nil && !fs.inUpperLocked(p) {
+		return &os.PathError{Op: "symlink", Path: p, Err: os.ErrExist}
+	}
+	return fs.upper.Symlink(target, p)
+}
+
+func (fs *TreeFS) Readlink(link string) (string, error) {
+	p := cleanPath(link)
+
+	fs.mu.Lock()
+	if fs.inUpperLocked(p) {
+		defer fs.mu.Unlock()
+		return fs.upper.Readlink(p)
+	}
+	entry, ok := fs.lowerFileLocked(p)
+	fs.mu.Unlock()
+	if !ok || entry.Mode != filemode.Symlink {
+		return "", &os.PathError{Op: "readlink", Path: p, Err: errors.New("not a symlink")}
+	}
+
+	target, err := fs.readBlob(entry.Hash)
+	return string(target), err
+}
+
+func (fs *TreeFS) Chroot(p string) (billy.Filesystem, error) {
+	return chroot.New(fs, p), nil
+}
+
+func (fs *TreeFS) Root() string {
+	return fs.upper.Root()
+}
+
+func (fs *TreeFS) Capabilities() billy.Capability {
+	return billy.Capabilities(fs.upper)
+}
+
+// blobFile is a read only file holding the content of a blob, either in
+// memory or in a spooled copy that closer closes
+type blobFile struct {
+	name    string
+	content interface {
+		io.Reader
+		io.ReaderAt
+		io.Seeker
+	}
+	closer io.Closer
+}
+
+func (f *blobFile) Name() string                            { return f.name }
+func (f *blobFile) Read(p []byte) (int, error)              { return f.content.Read(p) }
+func (f *blobFile) ReadAt(p []byte, off int64) (int, error) { return f.content.ReadAt(p, off) }
+func (f *blobFile) Seek(offset int64, whence int) (int64, error) {
+	return f.content.Seek(offset, whence)
+}
+func (f *blobFile) Lock() error   { return nil }
+func (f *blobFile) Unlock() error { return nil }
+
+func (f *blobFile) Close() error {
+	if f.closer == nil {
+		return nil
+	}
+	return f.closer.Close()
+}
+
+func (f *blobFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+}
+
+func (f *blobFile) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrPermission}
+}
+
+// treeFileInfo is the file info of a file of the tree
+type treeFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	sys     any
+}
+
+func (i *treeFileInfo) Name() string       { return i.name }
+func (i *treeFileInfo) Size() int64        { return i.size }
+func (i *treeFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *treeFileInfo) ModTime() time.Time { return i.modTime }
+func (i *treeFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *treeFileInfo) Sys() any           { return i.sys }